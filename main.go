@@ -1,30 +1,292 @@
 package main
 
 import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/security/keyvault/azsecrets"
 	"github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/insights/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/marketplaceordering/v2"
 	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
+	networkv20240501 "github.com/pulumi/pulumi-azure-native-sdk/network/v2/v20240501"
 	"github.com/pulumi/pulumi-azure-native-sdk/resources/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/storage/v2"
 	"github.com/pulumi/pulumi-random/sdk/v4/go/random"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
+	"gopkg.in/yaml.v3"
 )
 
+type ASG struct {
+	Name string
+	Tags map[string]string
+}
+
+type ApplicationGateway struct {
+	BackendNicName                 string
+	BackendPort                    int
+	BackendProtocol                string
+	Capacity                       int
+	CertificateSecretId            string
+	FrontendPipName                string
+	FrontendPort                   int
+	IdentityId                     string
+	Name                           string
+	SkuName                        string
+	SnetName                       string
+	Tags                           map[string]string
+	TrustedRootCertificateSecretId string
+}
+
+type AvailabilitySet struct {
+	Name                      string
+	PlatformFaultDomainCount  int
+	PlatformUpdateDomainCount int
+}
+
+type Bastion struct {
+	AddressPrefix string
+	Name          string
+	PipName       string
+	SkuName       string
+	Tags          map[string]string
+}
+
+type Bootstrap struct {
+	FileShare          string
+	ShareDirectory     string
+	SnetName           string
+	StorageAccountName string
+}
+
+type Config struct {
+	AcceleratedNetworkingVmSizes []string
+	AcceptMarketplaceTerms       bool
+	Bootstrap                    Bootstrap
+	CustomTimeouts               CustomTimeouts
+	DefaultRules                 []Rule
+	DefaultRulesPriorityBase     int
+	DeploymentBatch              string
+	DeployVM                     bool
+	DiagnosticSettings           DiagnosticSettings
+	DnsZone                      DnsZone
+	Environment                  string
+	FlatHierarchy                bool
+	HaPair                       HaPair
+	IgnoreTagChanges             bool
+	InheritResourceGroupTags     bool
+	Location                     string
+	NamePrefix                   string
+	OsDiskIdLength               int
+	OsDiskIdUpper                bool
+	PinLatest                    bool
+	ProtectResources             *bool
+	RandomizeNames               bool
+	ResourceGroup                ResourceGroup
+	ResourceManagerEndpoint      string
+	Stack                        string
+	TagDeploymentBatch           bool
+	Tags                         Tags
+	VMs                          []VM
+	VNET                         VNET
+}
+
+type ConfigFile struct {
+	Tags Tags
+	VM   *VM
+	VMs  []VM
+	VNET VNET
+}
+
+type CustomTimeouts struct {
+	Create string
+	Delete string
+	Update string
+}
+
+type DataDisk struct {
+	Caching                 string
+	DeleteOption            string
+	DiskEncryptionSetId     string
+	DiskSizeGB              int
+	Lun                     int
+	Name                    string
+	StorageAccountType      string
+	WriteAcceleratorEnabled bool
+}
+
+type DiagnosticSettings struct {
+	WorkspaceId string
+}
+
+type DnsZone struct {
+	Name              string
+	ResourceGroupName string
+	Ttl               int
+}
+
+type Encryption struct {
+	Enabled     bool
+	Enforcement string
+}
+
+type EnvironmentPreset struct {
+	EvictionPolicy   string
+	OsDiskSizeGB     int
+	Priority         string
+	ProtectResources bool
+	Zone             string
+}
+
+type Extension struct {
+	Name               string
+	Publisher          string
+	Settings           map[string]interface{}
+	Type               string
+	TypeHandlerVersion string
+}
+
+type FlowLog struct {
+	Enabled                     bool
+	NetworkWatcherName          string
+	NetworkWatcherResourceGroup string
+	RetentionDays               int
+	StorageAccountId            string
+}
+
+type HaPair struct {
+	DataplaneNic             string
+	FrontendPipName          string
+	FrontendPrivateIpAddress string
+	FrontendSnetName         string
+	Name                     string
+	Probe                    Probe
+	Rules                    []LBRule
+	Tags                     map[string]string
+	VmNames                  []string
+}
+
+type Identity struct {
+	Type                   string
+	UserAssignedIdentities []string
+}
+
 type Image struct {
-	Offer     string
+	HyperVGeneration string
+	Id               string
+	Offer            string
+	Plan             ImagePlan
+	Publisher        string
+	Sku              string
+	Version          string
+}
+
+type ImagePlan struct {
+	Name      string
+	Product   string
 	Publisher string
-	Sku       string
-	Version   string
+}
+
+type Inventory struct {
+	Resources     []InventoryResource `json:"resources"`
+	SchemaVersion int                 `json:"schemaVersion"`
+}
+
+type InventoryResource struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type IpConfig struct {
+	GatewayLoadBalancerFrontendId string
+	Name                          string
+	PipName                       string
+	Primary                       bool
+	PrivateIpAddress              string
+	SnetName                      string
+	Version                       string
+}
+
+type LB struct {
+	BackendNics              []string
+	FrontendPrivateIpAddress string
+	FrontendSnetName         string
+	Name                     string
+	Probe                    Probe
+	Rules                    []LBRule
+	Tags                     map[string]string
+}
+
+type LBRule struct {
+	BackendPort          int
+	EnableFloatingIP     bool
+	FrontendPort         int
+	IdleTimeoutInMinutes int
+	Name                 string
+	Protocol             string
+}
+
+type LoggingVolume struct {
+	Caching            string
+	DiskCount          int
+	DiskSizeGB         int
+	Name               string
+	StartLun           int
+	StorageAccountType string
+}
+
+type LoggingVolumeLayout struct {
+	Caching    string
+	DiskSizeGB int
+	Luns       []int
+}
+
+type NATGW struct {
+	IdleTimeoutInMinutes int
+	Name                 string
+	PipName              string
+	Tags                 map[string]string
 }
 
 type NIC struct {
+	ApplicationSecurityGroups   []string
+	AuxiliaryMode               string
+	AuxiliarySku                string
+	DisableTcpStateTracking     bool
+	DnsServers                  []string
 	EnableAcceleratedNetworking bool
 	EnableIPForwarding          bool
+	Existing                    bool
+	Id                          string
+	IpConfigName                string
+	IpConfigurations            []IpConfig
 	Name                        string
+	NicType                     string
 	PipName                     string
+	PrivateIpAddress            string
 	SnetName                    string
+	Tags                        map[string]string
 }
 
 type NICMAP struct {
@@ -34,12 +296,98 @@ type NICMAP struct {
 }
 
 type NSG struct {
-	Name  string
-	Rules []Rule
+	FlowLog          FlowLog
+	Name             string
+	Rules            []Rule
+	SkipDefaultRules bool
+	Tags             map[string]string
+}
+
+type OutboundRule struct {
+	AllocatedOutboundPorts int
+	BackendNics            []string
+	IdleTimeoutInMinutes   int
+	Name                   string
+	PipName                string
+	Tags                   map[string]string
+}
+
+type Peering struct {
+	AllowForwardedTraffic  bool
+	AllowGatewayTransit    bool
+	Name                   string
+	RemoteVirtualNetworkId string
+	UseRemoteGateways      bool
 }
 
 type PIP struct {
-	Name string
+	AllocationMethod     string
+	DnsRecordName        string
+	DomainNameLabel      string
+	Existing             bool
+	Id                   string
+	IdleTimeoutInMinutes int
+	Name                 string
+	ReverseFqdn          string
+	SkuName              string
+	SkuTier              string
+	Tags                 map[string]string
+	Version              string
+	ZoneRedundant        bool
+	Zones                []string
+}
+
+type Plan struct {
+	Bootstrap                Bootstrap
+	DeploymentBatch          string
+	DeployVM                 bool
+	DiagnosticSettings       DiagnosticSettings
+	DnsZone                  DnsZone
+	FlatHierarchy            bool
+	HaPair                   HaPair
+	IgnoreTagChanges         bool
+	InheritResourceGroupTags bool
+	Location                 string
+	LoggingVolumes           map[string]LoggingVolumeLayout
+	MarketplaceAgreements    []ImagePlan
+	NameSuffix               string
+	OsDiskIdLength           int
+	OsDiskIdUpper            bool
+	PinLatest                bool
+	ProtectResources         bool
+	RandomizeNames           bool
+	ResourceCounts           ResourceCounts
+	ResourceGroup            ResourceGroup
+	ResourceManagerEndpoint  string
+	TagDeploymentBatch       bool
+	Tags                     Tags
+	Timeouts                 *pulumi.CustomTimeouts
+	VMs                      []VM
+	VNET                     VNET
+	Warnings                 []string
+}
+
+type Probe struct {
+	IntervalInSeconds int
+	Name              string
+	NumberOfProbes    int
+	Port              int
+	Protocol          string
+	RequestPath       string
+}
+
+type ResourceCounts struct {
+	NICs        int
+	NSGs        int
+	PublicIPs   int
+	RouteTables int
+	Subnets     int
+	VMs         int
+}
+
+type ResourceGroup struct {
+	Existing bool
+	Name     string
 }
 
 type Route struct {
@@ -53,25 +401,42 @@ type RT struct {
 	Name                       string
 	DisableBgpRoutePropagation bool
 	Routes                     []Route
+	Tags                       map[string]string
 }
 
 type Rule struct {
-	Access                   string
-	DestinationAddressPrefix string
-	DestinationPortRange     string
-	Direction                string
-	Name                     string
-	Priority                 int
-	Protocol                 string
-	SourceAddressPrefix      string
-	SourcePortRange          string
+	Access                               string
+	Description                          string
+	DestinationAddressPrefix             string
+	DestinationAddressPrefixes           []string
+	DestinationApplicationSecurityGroups []string
+	DestinationPortRange                 string
+	DestinationPortRanges                []string
+	Direction                            string
+	Name                                 string
+	Priority                             int
+	Protocol                             string
+	SourceAddressPrefix                  string
+	SourceAddressPrefixes                []string
+	SourceApplicationSecurityGroups      []string
+	SourcePortRange                      string
+	SourcePortRanges                     []string
 }
 
 type SNET struct {
-	AddressPrefix string
-	Name          string
-	NSGName       string
-	RTName        string
+	AddressPrefix                     string
+	AddressPrefixes                   []string
+	DefaultOutboundAccess             *bool
+	Delegations                       []string
+	Existing                          bool
+	Id                                string
+	Name                              string
+	NatGatewayName                    string
+	NSGName                           string
+	PrivateEndpointNetworkPolicies    string
+	PrivateLinkServiceNetworkPolicies string
+	RTName                            string
+	ServiceEndpoints                  []string
 }
 
 type Tags struct {
@@ -80,372 +445,5199 @@ type Tags struct {
 }
 
 type VM struct {
-	AdminPassword      string
-	AdminUsername      string
-	ComputerName       string
-	Image              Image
-	NicMap             NICMAP
-	StorageAccountType string
-	VmSize             string
+	AdminPassword                 string
+	AdminPasswordSecretId         string
+	AdminUsername                 string
+	AssessmentMode                string
+	AvailabilitySet               AvailabilitySet
+	AvailabilitySetId             string
+	BootDiagnostics               bool
+	BootDiagnosticsStorageUri     string
+	ComputerName                  string
+	Count                         int
+	CustomData                    string
+	CustomDataFile                string
+	DataDisks                     []DataDisk
+	DiskEncryptionSetId           string
+	EncryptionAtHost              bool
+	EphemeralOsDisk               bool
+	EphemeralOsDiskPlacement      string
+	EvictionPolicy                string
+	Extensions                    []Extension
+	HibernationEnabled            bool
+	Identity                      Identity
+	Image                         Image
+	LoggingVolume                 LoggingVolume
+	MaxPrice                      float64
+	Name                          string
+	NicMap                        NICMAP
+	OsDiskCaching                 string
+	OsDiskCreateOption            string
+	OsDiskDeleteOption            string
+	OsDiskId                      string
+	OsDiskSizeGB                  int
+	OsDiskWriteAcceleratorEnabled bool
+	OsType                        string
+	PatchMode                     string
+	Priority                      string
+	ProximityPlacementGroupId     string
+	SecureBootEnabled             bool
+	SecurityType                  string
+	SshPublicKeys                 []string
+	StorageAccountType            string
+	Tags                          map[string]string
+	UserData                      string
+	VTpmEnabled                   bool
+	VmSize                        string
+	WaitForAgentReady             bool
+	Zone                          string
 }
 
 type VNET struct {
-	AddressSpace string
-	NIC          []NIC
-	NSG          []NSG
-	PIP          []PIP
-	RT           []RT
-	SNET         []SNET
+	ASG                []ASG
+	AddressSpace       string
+	AddressSpaces      []string
+	ApplicationGateway ApplicationGateway
+	Bastion            Bastion
+	Encryption         Encryption
+	LoadBalancer       LB
+	NATGW              []NATGW
+	NIC                []NIC
+	NSG                []NSG
+	OutboundRule       OutboundRule
+	PIP                []PIP
+	Peerings           []Peering
+	RT                 []RT
+	SNET               []SNET
+	Tags               map[string]string
 }
 
 func main() {
-	pulumi.Run(func(ctx *pulumi.Context) error {
+	pulumi.Run(run)
+}
+
+// run reads the stack configuration and creates its resources.
+func run(ctx *pulumi.Context) error {
 
-		// Export the project's readme.
+	// Define a variable for Pulumi configuration.
+	cfg := config.New(ctx, "")
+
+	// Export the project's readme, unless exportReadme is false.
+	if cfg.Get("exportReadme") == "" || cfg.GetBool("exportReadme") {
 		readmeBytes, err := os.ReadFile("./README.md")
-		if err != nil {
+		switch {
+		case err == nil:
+			ctx.Export("readme", pulumi.String(string(readmeBytes)))
+		case errors.Is(err, fs.ErrNotExist):
+			ctx.Log.Warn("README.md not found, skipping the readme export", nil)
+		case cfg.Get("exportReadme") != "":
 			return fmt.Errorf("failed to read readme: %w", err)
+		default:
+			ctx.Log.Warn(fmt.Sprintf("failed to read readme, skipping the readme export: %v", err), nil)
 		}
-		ctx.Export("readme", pulumi.String(string(readmeBytes)))
+	}
 
-		// Define a variable for Pulumi configuration.
-		cfg := config.New(ctx, "")
+	// Define the path of an optional JSON or YAML file holding the tags, vnet and vm or vms settings.
+	configFile := cfg.Get("configFile")
+	var fileConfig ConfigFile
+	var err error
+	if configFile != "" {
+		fileConfig, err = readConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Warn about structured config keys that no config field reads, such as a mistyped nested key.
+	if err := validateConfigSchema(ctx, cfg); err != nil {
+		return err
+	}
 
-		// Define a variable for resource tagging. This sources from Pulumi configuration via the Tags type struct declaration.
-		var tags Tags
+	// Define a variable for resource tagging. This sources from Pulumi configuration via the Tags type struct declaration.
+	var tags Tags
+	if configFile != "" {
+		tags = fileConfig.Tags
+	} else {
 		cfg.RequireObject("tags", &tags)
+	}
 
-		// Define a variable for network properties. This sources from Pulumi configuration via the VNET type struct declaration.
-		var vnet VNET
+	// Define a variable for network properties. This sources from Pulumi configuration via the VNET type struct declaration.
+	var vnet VNET
+	if configFile != "" {
+		vnet = fileConfig.VNET
+	} else {
 		cfg.RequireObject("vnet", &vnet)
+	}
 
-		// Define a variable for VM properties. This sources from Pulumi configuration via the VM type struct declaration.
-		var vm VM
-		cfg.RequireObject("vm", &vm)
+	// Define whether to deploy the VMs. Setting deployVM to false creates only the network fabric, for staged rollouts.
+	deployVM := true
+	if cfg.Get("deployVM") != "" {
+		deployVM = cfg.GetBool("deployVM")
+	}
 
-		// Define required tags for the project.
-		requiredTags := pulumi.StringMap{
-			"automation": pulumi.String(tags.Automation),
-			"solution":   pulumi.String(tags.Solution),
+	// Define a variable for VM properties. This sources from Pulumi configuration via the VM type struct declaration.
+	var vms []VM
+	if deployVM && configFile != "" {
+		vms = fileConfig.VMs
+		if len(vms) == 0 && fileConfig.VM != nil {
+			vms = append(vms, *fileConfig.VM)
 		}
+		if len(vms) == 0 {
+			return fmt.Errorf("config file %q defines neither vm nor vms, set deployVM to false to deploy only the network", configFile)
+		}
+	} else if deployVM {
+		if cfg.Get("vms") != "" {
+			cfg.RequireObject("vms", &vms)
+		} else {
+			var vm VM
+			cfg.RequireObject("vm", &vm)
+			vms = append(vms, vm)
+		}
+	}
 
-		// Define the standard nameSuffix variable to use for naming Pulumi resources.
-		nameSuffix := "panos-vm-" + ctx.Stack() + "-"
+	// Define the environment, which selects a preset of defaults applied by buildPlan. No preset applies when unset.
+	environment := cfg.Get("environment")
 
-		// Create an Azure Resource Group
-		resourceGroup, err := resources.NewResourceGroup(ctx, "rg-"+nameSuffix, &resources.ResourceGroupArgs{
-			Tags: requiredTags,
-		})
-		if err != nil {
-			return err
+	// Define extra VM sizes that support accelerated networking, for sizes missing from the built-in table.
+	var extraAcceleratedNetworkingVmSizes []string
+	if err := cfg.GetObject("acceleratedNetworkingVmSizes", &extraAcceleratedNetworkingVmSizes); err != nil {
+		return fmt.Errorf("failed to read acceleratedNetworkingVmSizes: %w", err)
+	}
+
+	// Define whether the required tags are propagated from the resource group to its children.
+	inheritResourceGroupTags := true
+	if cfg.Get("inheritResourceGroupTags") != "" {
+		inheritResourceGroupTags = cfg.GetBool("inheritResourceGroupTags")
+	}
+
+	// Define whether to protect the resource group, VMs and OS disk IDs from deletion, for production stacks.
+	var protectResources *bool
+	if cfg.Get("protectResources") != "" {
+		protect := cfg.GetBool("protectResources")
+		protectResources = &protect
+	}
+
+	// Define the timeouts for the VMs, their extensions and the load balancers, as durations such as "45m".
+	var customTimeouts CustomTimeouts
+	if err := cfg.GetObject("customTimeouts", &customTimeouts); err != nil {
+		return fmt.Errorf("failed to read customTimeouts: %w", err)
+	}
+
+	// Define the resource group. By default a new one is created.
+	var resourceGroup ResourceGroup
+	if err := cfg.GetObject("resourceGroup", &resourceGroup); err != nil {
+		return fmt.Errorf("failed to read resourceGroup: %w", err)
+	}
+
+	// Define the baseline rules added to every NSG that doesn't skip them, and the base their priorities are offset from.
+	var defaultRules []Rule
+	if err := cfg.GetObject("defaultRules", &defaultRules); err != nil {
+		return fmt.Errorf("failed to read defaultRules: %w", err)
+	}
+	defaultRulesPriorityBase := 100
+	if cfg.Get("defaultRulesPriorityBase") != "" {
+		defaultRulesPriorityBase = cfg.GetInt("defaultRulesPriorityBase")
+	}
+
+	// Define the Log Analytics workspace that receives the virtual network's and NSGs' logs, if any.
+	var diagnosticSettings DiagnosticSettings
+	if err := cfg.GetObject("diagnosticSettings", &diagnosticSettings); err != nil {
+		return fmt.Errorf("failed to read diagnosticSettings: %w", err)
+	}
+
+	// Define the existing DNS zone that holds the A records of Public IPs with a dnsRecordName.
+	var dnsZone DnsZone
+	if err := cfg.GetObject("dnsZone", &dnsZone); err != nil {
+		return fmt.Errorf("failed to read dnsZone: %w", err)
+	}
+
+	// Define the active/passive firewall pair fronted by its own load balancer, if any.
+	var haPair HaPair
+	if err := cfg.GetObject("haPair", &haPair); err != nil {
+		return fmt.Errorf("failed to read haPair: %w", err)
+	}
+
+	// Define the length and character set of the random IDs appended to disk names. Changing either replaces the VMs.
+	osDiskIdLength := 8
+	if cfg.Get("osDiskIdLength") != "" {
+		osDiskIdLength = cfg.GetInt("osDiskIdLength")
+	}
+
+	// Define the storage account and file share for PAN-OS bootstrapping, if any.
+	var bootstrap Bootstrap
+	if err := cfg.GetObject("bootstrap", &bootstrap); err != nil {
+		return fmt.Errorf("failed to read bootstrap: %w", err)
+	}
+
+	// Define the Resource Manager endpoint of the provider's Azure cloud, which pinLatest lists image versions from.
+	azureEnvironment := config.New(ctx, "azure-native").Get("environment")
+	resourceManagerEndpoint, exists := resourceManagerEndpoints[azureEnvironment]
+	if !exists && azureEnvironment != "" {
+		return fmt.Errorf("azure-native:environment %q is unknown, expected public, usgovernment or china", azureEnvironment)
+	}
+
+	// Validate and normalize the configuration into a plan, then create its resources.
+	plan, err := buildPlan(Config{
+		AcceleratedNetworkingVmSizes: extraAcceleratedNetworkingVmSizes,
+		AcceptMarketplaceTerms:       cfg.GetBool("acceptMarketplaceTerms"),
+		Bootstrap:                    bootstrap,
+		CustomTimeouts:               customTimeouts,
+		DefaultRules:                 defaultRules,
+		DefaultRulesPriorityBase:     defaultRulesPriorityBase,
+		DeploymentBatch:              cfg.Get("deploymentBatch"),
+		DeployVM:                     deployVM,
+		DiagnosticSettings:           diagnosticSettings,
+		DnsZone:                      dnsZone,
+		Environment:                  environment,
+		FlatHierarchy:                cfg.GetBool("flatHierarchy"),
+		HaPair:                       haPair,
+		IgnoreTagChanges:             cfg.GetBool("ignoreTagChanges"),
+		InheritResourceGroupTags:     inheritResourceGroupTags,
+		Location:                     cfg.Get("location"),
+		NamePrefix:                   cfg.Get("namePrefix"),
+		OsDiskIdLength:               osDiskIdLength,
+		OsDiskIdUpper:                cfg.GetBool("osDiskIdUpper"),
+		PinLatest:                    cfg.GetBool("pinLatest"),
+		ProtectResources:             protectResources,
+		RandomizeNames:               cfg.GetBool("randomizeNames"),
+		ResourceGroup:                resourceGroup,
+		ResourceManagerEndpoint:      resourceManagerEndpoint,
+		Stack:                        ctx.Stack(),
+		TagDeploymentBatch:           cfg.GetBool("tagDeploymentBatch"),
+		Tags:                         tags,
+		VMs:                          vms,
+		VNET:                         vnet,
+	})
+	if err != nil {
+		return err
+	}
+	return apply(ctx, plan)
+}
+
+// buildPlan validates the configuration and normalizes it into a plan: NICs get their IP configurations, VMs get their
+// environment preset and logging volume disks, NSGs get their default rules, and every resource is checked against the
+// resources it references. It doesn't touch Pulumi or Azure, so configurations can be checked without either, and it
+// never modifies the slices of cfg.
+func buildPlan(cfg Config) (*Plan, error) {
+	tags, vnet, vms := cfg.Tags, cfg.VNET, slices.Clone(cfg.VMs)
+	vnet.NIC = slices.Clone(vnet.NIC)
+	vnet.NSG = slices.Clone(vnet.NSG)
+
+	// Stamp out each VM with a count into that many instances, before their NICs are normalized below.
+	vnet, vms, err := expandVmCounts(vnet, vms)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add the AzureBastionSubnet for the Bastion host from its addressPrefix, unless the subnet is configured directly.
+	if bastion := vnet.Bastion; bastion.Name != "" && bastion.AddressPrefix != "" {
+		if slices.ContainsFunc(vnet.SNET, func(snet SNET) bool { return snet.Name == bastionSubnetName }) {
+			return nil, fmt.Errorf("bastion %q sets addressPrefix, but subnet %q is already configured", bastion.Name, bastionSubnetName)
 		}
+		vnet.SNET = append(slices.Clone(vnet.SNET), SNET{AddressPrefix: bastion.AddressPrefix, Name: bastionSubnetName})
+	}
 
-		// Create Network Security Groups and Security Rules.
-		nsgMap := make(map[string]*network.NetworkSecurityGroup)
-		for _, nsg := range vnet.NSG {
-			var securityRules network.SecurityRuleTypeArray
-			for _, rule := range nsg.Rules {
-				securityRules = append(securityRules, network.SecurityRuleTypeArgs{
-					Access:                   pulumi.String(rule.Access),
-					DestinationAddressPrefix: pulumi.String(rule.DestinationAddressPrefix),
-					DestinationPortRange:     pulumi.String(rule.DestinationPortRange),
-					Direction:                pulumi.String(rule.Direction),
-					Name:                     pulumi.String(rule.Name),
-					Priority:                 pulumi.Int(rule.Priority),
-					Protocol:                 pulumi.String(rule.Protocol),
-					SourceAddressPrefix:      pulumi.String(rule.SourceAddressPrefix),
-					SourcePortRange:          pulumi.String(rule.SourcePortRange),
-				})
+	// Define each NIC's IP configurations, falling back to a single primary configuration, which is moved first.
+	snets := make(map[string]SNET)
+	for _, snet := range vnet.SNET {
+		snets[snet.Name] = snet
+	}
+	pipVersions := make(map[string]string)
+	for _, pip := range vnet.PIP {
+		if !pip.Existing {
+			pipVersions[pip.Name] = valueOrDefault(pip.Version, "IPv4")
+		}
+	}
+	for i, nic := range vnet.NIC {
+		if err := validateExisting("nic", nic.Name, nic.Existing, nic.Id, networkInterfaceIdPattern); err != nil {
+			return nil, err
+		}
+		if nic.Existing {
+			if len(nic.IpConfigurations) > 0 || nic.IpConfigName != "" || nic.SnetName != "" || nic.PipName != "" || nic.PrivateIpAddress != "" {
+				return nil, fmt.Errorf("nic %q is existing, so cannot set ipConfigurations, ipConfigName, snetName, pipName or privateIpAddress", nic.Name)
+			}
+			continue
+		}
+		if len(nic.IpConfigurations) > 0 && nic.IpConfigName != "" {
+			return nil, fmt.Errorf("nic %q cannot set both ipConfigName and ipConfigurations", nic.Name)
+		}
+		if len(nic.IpConfigurations) == 0 {
+			nic.IpConfigurations = []IpConfig{{
+				Name:             valueOrDefault(nic.IpConfigName, "ipconfig"),
+				PipName:          nic.PipName,
+				Primary:          true,
+				PrivateIpAddress: nic.PrivateIpAddress,
+				SnetName:         nic.SnetName,
+			}}
+		}
+		nic.IpConfigurations = slices.Clone(nic.IpConfigurations)
+		primaryCount := 0
+		ipConfigNames := make(map[string]bool)
+		for _, ipConfig := range nic.IpConfigurations {
+			if strings.TrimSpace(ipConfig.Name) == "" {
+				return nil, fmt.Errorf("nic %q has an ip configuration without a name", nic.Name)
+			}
+			if len(ipConfig.Name) > 80 {
+				return nil, fmt.Errorf("nic %q ip configuration name %q exceeds the 80 character limit", nic.Name, ipConfig.Name)
+			}
+			if ipConfigNames[ipConfig.Name] {
+				return nil, fmt.Errorf("nic %q has more than one ip configuration named %q", nic.Name, ipConfig.Name)
+			}
+			ipConfigNames[ipConfig.Name] = true
+			if ipConfig.GatewayLoadBalancerFrontendId != "" && !loadBalancerFrontendIdPattern.MatchString(ipConfig.GatewayLoadBalancerFrontendId) {
+				return nil, fmt.Errorf("nic %q ip configuration %q has invalid gatewayLoadBalancerFrontendId %q", nic.Name, ipConfig.Name, ipConfig.GatewayLoadBalancerFrontendId)
+			}
+			snet, exists := snets[ipConfig.SnetName]
+			if !exists {
+				return nil, fmt.Errorf("nic %q ip configuration %q references unknown subnet %q", nic.Name, ipConfig.Name, ipConfig.SnetName)
 			}
 
-			nsgResource, err := network.NewNetworkSecurityGroup(ctx, "nsg-"+nsg.Name+"-"+nameSuffix, &network.NetworkSecurityGroupArgs{
-				ResourceGroupName: resourceGroup.Name,
-				SecurityRules:     securityRules,
-				Tags:              requiredTags,
-			},
-				pulumi.DependsOn([]pulumi.Resource{resourceGroup}),
-				pulumi.Parent(resourceGroup),
-			)
-			if err != nil {
-				return err
+			// Ensure IPv6 configurations are secondary, sit in a subnet with an IPv6 prefix, and match their Public IP's version.
+			version := valueOrDefault(ipConfig.Version, "IPv4")
+			switch version {
+			case "IPv4":
+			case "IPv6":
+				if ipConfig.Primary {
+					return nil, fmt.Errorf("nic %q ip configuration %q is IPv6, which cannot be the primary ip configuration", nic.Name, ipConfig.Name)
+				}
+				if !snet.Existing && !slices.ContainsFunc(subnetAddressPrefixes(snet), func(prefix string) bool { return strings.Contains(prefix, ":") }) {
+					return nil, fmt.Errorf("nic %q ip configuration %q is IPv6, but subnet %q has no IPv6 address prefix", nic.Name, ipConfig.Name, snet.Name)
+				}
+			default:
+				return nil, fmt.Errorf("nic %q ip configuration %q has unknown version %q, expected IPv4 or IPv6", nic.Name, ipConfig.Name, ipConfig.Version)
+			}
+			if pipVersion, exists := pipVersions[ipConfig.PipName]; exists && pipVersion != version {
+				return nil, fmt.Errorf("nic %q ip configuration %q is %s, but public ip %q is %s", nic.Name, ipConfig.Name, version, ipConfig.PipName, pipVersion)
+			}
+			if ipConfig.Primary {
+				primaryCount++
 			}
-			nsgMap[nsg.Name] = nsgResource
 		}
-
-		/*
-			// Export the nsgMap to a stack output. For debugging.
-			nsgMapOutput := pulumi.StringMap{}
-			for key, nsg := range nsgMap {
-				nsgMapOutput[key] = nsg.ID().ToStringOutput()
+		if primaryCount != 1 {
+			return nil, fmt.Errorf("nic %q must have exactly one primary ip configuration, found %d", nic.Name, primaryCount)
+		}
+		slices.SortStableFunc(nic.IpConfigurations, func(a, b IpConfig) int {
+			if a.Primary == b.Primary {
+				return 0
 			}
-			ctx.Export("nsgMap", nsgMapOutput)
-		*/
+			if a.Primary {
+				return -1
+			}
+			return 1
+		})
+		vnet.NIC[i] = nic
+	}
 
-		// Create Route Tables and Routes.
-		rtMap := make(map[string]*network.RouteTable)
-		for _, rt := range vnet.RT {
-			var routes network.RouteTypeArray
-			for _, route := range rt.Routes {
-				routes = append(routes, network.RouteTypeArgs{
-					AddressPrefix:    pulumi.String(route.AddressPrefix),
-					Name:             pulumi.String(route.Name),
-					NextHopType:      pulumi.String(route.NextHopType),
-					NextHopIpAddress: pulumi.String(route.NextHopIpAddress),
-				})
+	// Define the environment, which selects a preset of defaults. Values set in config always win over the preset's.
+	preset, known := environmentPresets[cfg.Environment]
+	if cfg.Environment != "" && !known {
+		return nil, fmt.Errorf("unknown environment %q, expected dev, test or prod", cfg.Environment)
+	}
+	for i, vm := range vms {
+		vms[i] = applyEnvironmentPreset(vm, preset)
+	}
+
+	// Expand each VM's logging volume into equally sized data disks on consecutive LUNs.
+	loggingVolumes := make(map[string]LoggingVolumeLayout)
+	for i, vm := range vms {
+		if vm.LoggingVolume.DiskCount == 0 {
+			continue
+		}
+		disks, err := loggingVolumeDisks(vm.LoggingVolume)
+		if err != nil {
+			return nil, fmt.Errorf("vm %q: %w", vmKey(vm), err)
+		}
+		layout := LoggingVolumeLayout{
+			Caching:    disks[0].Caching,
+			DiskSizeGB: vm.LoggingVolume.DiskSizeGB,
+		}
+		for _, disk := range disks {
+			layout.Luns = append(layout.Luns, disk.Lun)
+		}
+		loggingVolumes[vmKey(vm)] = layout
+		vms[i].DataDisks = append(slices.Clone(vms[i].DataDisks), disks...)
+	}
+
+	// Define the VM sizes that support accelerated networking. Sizes missing from the built-in table can be added via config.
+	acceleratedNetworkingVmSizes := make(map[string]bool)
+	for _, size := range defaultAcceleratedNetworkingVmSizes {
+		acceleratedNetworkingVmSizes[strings.ToLower(size)] = true
+	}
+	for _, size := range cfg.AcceleratedNetworkingVmSizes {
+		acceleratedNetworkingVmSizes[strings.ToLower(size)] = true
+	}
+
+	// Define the standard nameSuffix used for naming Pulumi resources. The prefix defaults to "panos-vm".
+	nameSuffix := valueOrDefault(cfg.NamePrefix, "panos-vm") + "-" + cfg.Stack + "-"
+
+	// Ensure the random IDs appended to disk names fit within the disk name limits.
+	if cfg.OsDiskIdLength < 4 || cfg.OsDiskIdLength > 32 {
+		return nil, fmt.Errorf("osDiskIdLength must be between 4 and 32, got %d", cfg.OsDiskIdLength)
+	}
+
+	// Validate each VM, and ensure no NIC is attached to more than one VM.
+	vmNames := make(map[string]bool)
+	nicOwners := make(map[string]string)
+	for _, vm := range vms {
+		if len(vms) > 1 && vm.Name == "" {
+			return nil, fmt.Errorf("every vm requires a name when more than one vm is configured")
+		}
+		if vmNames[vm.Name] {
+			return nil, fmt.Errorf("vm name %q is used more than once", vm.Name)
+		}
+		vmNames[vm.Name] = true
+
+		// Ensure the VM can be logged into with either a password or SSH public keys.
+		attached := vm.OsDiskCreateOption == "Attach"
+		if err := validateAdminPasswordSource(vm); err != nil {
+			return nil, err
+		}
+		hasPassword := vm.AdminPassword != "" || vm.AdminPasswordSecretId != ""
+		switch vm.OsType {
+		case "", "Linux":
+			if !attached && !hasPassword && len(vm.SshPublicKeys) == 0 {
+				return nil, fmt.Errorf("vm %q requires either adminPassword, adminPasswordSecretId or sshPublicKeys to be set", vmKey(vm))
+			}
+		case "Windows":
+			if len(vm.SshPublicKeys) > 0 {
+				return nil, fmt.Errorf("vm %q cannot use sshPublicKeys with osType Windows", vmKey(vm))
 			}
+			if !attached && !hasPassword {
+				return nil, fmt.Errorf("vm %q requires adminPassword or adminPasswordSecretId to be set with osType Windows", vmKey(vm))
+			}
+		default:
+			return nil, fmt.Errorf("vm %q has unknown osType %q, expected Linux or Windows", vmKey(vm), vm.OsType)
+		}
+
+		// Ensure the admin username is one Azure accepts for the VM's OS type.
+		if err := validateAdminUsername(vm); err != nil {
+			return nil, err
+		}
+
+		// Ensure the VM's patch and assessment modes are valid for its OS type.
+		if err := validatePatchSettings(vm); err != nil {
+			return nil, err
+		}
 
-			// Ensure route tables depend on the network security groups.
-			routeTableDependencies := []pulumi.Resource{resourceGroup}
-			for _, nsgResource := range nsgMap {
-				routeTableDependencies = append(routeTableDependencies, nsgResource)
+		// Ensure the VM's user data fits within Azure's 64 KB limit once base64 encoded.
+		if size := base64.StdEncoding.EncodedLen(len(vm.UserData)); size > 64*1024 {
+			return nil, fmt.Errorf("vm %q userData is %d bytes once base64 encoded, over the 65536 byte limit", vmKey(vm), size)
+		}
+
+		// Ensure the VM's extension names are unique.
+		extensionNames := make(map[string]bool)
+		for _, extension := range vm.Extensions {
+			if extensionNames[extension.Name] {
+				return nil, fmt.Errorf("vm %q has more than one extension named %q", vmKey(vm), extension.Name)
 			}
+			extensionNames[extension.Name] = true
+		}
 
-			rtResource, err := network.NewRouteTable(ctx, "rt-"+rt.Name+"-"+nameSuffix, &network.RouteTableArgs{
-				DisableBgpRoutePropagation: pulumi.Bool(rt.DisableBgpRoutePropagation),
-				ResourceGroupName:          resourceGroup.Name,
-				Routes:                     routes,
-				Tags:                       requiredTags,
-			},
-				pulumi.DependsOn(routeTableDependencies),
-				pulumi.Parent(resourceGroup),
-			)
-			if err != nil {
-				return err
+		// Ensure spot pricing settings are only used with spot priority.
+		switch vm.Priority {
+		case "", "Regular", "Low":
+			if vm.EvictionPolicy != "" || vm.MaxPrice != 0 {
+				return nil, fmt.Errorf("vm %q evictionPolicy and maxPrice can only be set when priority is Spot", vmKey(vm))
+			}
+		case "Spot":
+			if vm.EvictionPolicy != "" && vm.EvictionPolicy != "Deallocate" && vm.EvictionPolicy != "Delete" {
+				return nil, fmt.Errorf("vm %q has unknown evictionPolicy %q, expected Deallocate or Delete", vmKey(vm), vm.EvictionPolicy)
 			}
-			rtMap[rt.Name] = rtResource
+			if vm.MaxPrice < 0 && vm.MaxPrice != -1 {
+				return nil, fmt.Errorf("vm %q maxPrice must be -1 or greater than zero", vmKey(vm))
+			}
+		default:
+			return nil, fmt.Errorf("vm %q has unknown priority %q, expected Regular, Low or Spot", vmKey(vm), vm.Priority)
+		}
+
+		// Ensure the VM's OS and data disk storage types can be hosted by the VM size.
+		if err := validateStorage(vm); err != nil {
+			return nil, err
+		}
+
+		// Ensure the VM uses at most one availability set, and isn't also pinned to a zone, which Azure forbids.
+		if vm.AvailabilitySetId != "" && vm.AvailabilitySet.Name != "" {
+			return nil, fmt.Errorf("vm %q cannot set both availabilitySetId and availabilitySet", vmKey(vm))
+		}
+		if (vm.AvailabilitySetId != "" || vm.AvailabilitySet.Name != "") && vm.Zone != "" {
+			return nil, fmt.Errorf("vm %q cannot use an availability set and zone %q together", vmKey(vm), vm.Zone)
 		}
 
-		/*
-			// Export the rtMap to a stack output.  For debugging.
-			rtMapOutput := pulumi.StringMap{}
-			for key, rt := range rtMap {
-				rtMapOutput[key] = rt.ID().ToStringOutput()
+		// Ensure the disk encryption sets used for customer-managed keys look like disk encryption set IDs.
+		if vm.DiskEncryptionSetId != "" && !diskEncryptionSetIdPattern.MatchString(vm.DiskEncryptionSetId) {
+			return nil, fmt.Errorf("vm %q has invalid diskEncryptionSetId %q", vmKey(vm), vm.DiskEncryptionSetId)
+		}
+		for _, disk := range vm.DataDisks {
+			if disk.DiskEncryptionSetId != "" && !diskEncryptionSetIdPattern.MatchString(disk.DiskEncryptionSetId) {
+				return nil, fmt.Errorf("vm %q data disk %q has invalid diskEncryptionSetId %q", vmKey(vm), disk.Name, disk.DiskEncryptionSetId)
 			}
-			ctx.Export("rtMap", rtMapOutput)
-		*/
+		}
 
-		// Define the nsgMap and rtMap as pulumi resources, so they can be used as dependencies for the virtual network resource.
-		virtualNetworkDependencies := []pulumi.Resource{}
-		for _, nsg := range nsgMap {
-			virtualNetworkDependencies = append(virtualNetworkDependencies, nsg)
+		// Ensure trusted launch and encryption at host are only requested for VM sizes and images that support them.
+		if err := validateSecurityProfile(vm); err != nil {
+			return nil, err
 		}
-		for _, rt := range rtMap {
-			virtualNetworkDependencies = append(virtualNetworkDependencies, rt)
+
+		// Ensure the VM's image is either a marketplace image or a managed or gallery image ID.
+		if err := validateImage(vm); err != nil {
+			return nil, err
+		}
+		if err := validatePlan(vm); err != nil {
+			return nil, err
 		}
 
-		// Create a virtual network.
-		virtualNetwork, err := network.NewVirtualNetwork(ctx, "vnet-"+nameSuffix, &network.VirtualNetworkArgs{
-			AddressSpace: &network.AddressSpaceArgs{
-				AddressPrefixes: pulumi.StringArray{
-					pulumi.String(vnet.AddressSpace),
-				},
-			},
-			ResourceGroupName: resourceGroup.Name,
-			Tags:              requiredTags,
-		},
-			pulumi.DependsOn(virtualNetworkDependencies),
-			pulumi.Parent(resourceGroup),
-		)
-		if err != nil {
-			return err
+		// Ensure hibernation is only enabled for VM sizes and disks that support it.
+		if err := validateHibernation(vm); err != nil {
+			return nil, err
 		}
 
-		// Create Subnets and associate with Network Security Groups and Route Tables.
-		snetMap := make(map[string]*network.Subnet)
-		snetResources := []pulumi.Resource{}
-		for _, snet := range vnet.SNET {
-			snetResource, err := network.NewSubnet(ctx, "snet-"+snet.Name, &network.SubnetArgs{
-				AddressPrefix: pulumi.String(snet.AddressPrefix),
-				NetworkSecurityGroup: &network.NetworkSecurityGroupTypeArgs{
-					Id: nsgMap[snet.NSGName].ID(),
-				},
-				ResourceGroupName: resourceGroup.Name,
-				RouteTable: &network.RouteTableTypeArgs{
-					Id: rtMap[snet.RTName].ID(),
-				},
-				VirtualNetworkName: virtualNetwork.Name,
-			},
-				pulumi.DependsOn(virtualNetworkDependencies),
-				pulumi.Parent(virtualNetwork),
-			)
-			if err != nil {
-				return err
-			}
-			snetMap[snet.Name] = snetResource
-			snetResources = append(snetResources, snetResource)
-		}
-
-		/*
-			// Export the subnetMap to a stack output. For debugging.
-			snetMapOutput := pulumi.StringMap{}
-			for key, snet := range snetMap {
-				snetMapOutput[key] = snet.ID().ToStringOutput()
-			}
-			ctx.Export("snetMap", snetMapOutput)
-		*/
-
-		// Create Public IP Addesses.
-		pipMap := make(map[string]*network.PublicIPAddress)
-		pipResources := []pulumi.Resource{}
-		for _, pip := range vnet.PIP {
-			pipResource, err := network.NewPublicIPAddress(ctx, "pip-"+pip.Name+"-"+nameSuffix, &network.PublicIPAddressArgs{
-				PublicIPAllocationMethod: pulumi.String("Static"),
-				ResourceGroupName:        resourceGroup.Name,
-				Sku: &network.PublicIPAddressSkuArgs{
-					Name: pulumi.String("Standard"),
-					Tier: pulumi.String("Regional"),
-				},
-				Tags: requiredTags,
-			},
-				pulumi.DependsOn(snetResources),
-				pulumi.Parent(resourceGroup),
-			)
-			if err != nil {
-				return err
+		// Ensure write acceleration is only enabled on M-series VM sizes, for Premium SSD disks.
+		if err := validateWriteAccelerator(vm); err != nil {
+			return nil, err
+		}
+
+		// Ensure the VM size can attach all of the VM's data disks, when the size's limit is known.
+		if maxDisks, known := maxDataDisks(vm.VmSize); known && vm.LoggingVolume.DiskCount > 0 && len(vm.DataDisks) > maxDisks {
+			return nil, fmt.Errorf("vm %q has %d data disks including its logging volume, but vm size %q supports at most %d", vmKey(vm), len(vm.DataDisks), vm.VmSize, maxDisks)
+		}
+
+		// Ensure ephemeral OS disks are only requested on VM sizes with local storage to hold them.
+		if err := validateEphemeralOsDisk(vm); err != nil {
+			return nil, err
+		}
+
+		// Ensure the disk names stay within Azure's managed disk naming rules once the random ID is appended.
+		randomIdPlaceholder := strings.Repeat("x", cfg.OsDiskIdLength)
+		if err := validateDiskName(resourceName(nameSuffix, "os", vm.Name) + randomIdPlaceholder); err != nil {
+			return nil, fmt.Errorf("vm %q: %w", vmKey(vm), err)
+		}
+		for _, disk := range vm.DataDisks {
+			if err := validateDiskName("data-" + disk.Name + "-" + vmDiskNameSuffix(vm, nameSuffix) + randomIdPlaceholder); err != nil {
+				return nil, fmt.Errorf("vm %q: %w", vmKey(vm), err)
 			}
-			pipMap[pip.Name] = pipResource
-			pipResources = append(pipResources, pipResource)
 		}
 
-		/*
-			// Export the pipMap to a stack output. For debugging.
-			pipMapOutput := pulumi.StringMap{}
-			for key, pip := range pipMap {
-				pipMapOutput[key] = pip.ID().ToStringOutput()
+		// Ensure the VM's OS disk and data disks are valid.
+		if err := validateDisks(vm); err != nil {
+			return nil, err
+		}
+
+		// Ensure the VM's managed identity type matches its user-assigned identities.
+		if err := validateIdentity(vm); err != nil {
+			return nil, err
+		}
+
+		// Ensure the VM's custom data has a single source.
+		if vm.CustomData != "" && vm.CustomDataFile != "" {
+			return nil, fmt.Errorf("vm %q customData and customDataFile are mutually exclusive", vmKey(vm))
+		}
+		if cfg.Bootstrap.StorageAccountName != "" && (vm.CustomData != "" || vm.CustomDataFile != "") {
+			return nil, fmt.Errorf("vm %q cannot set customData or customDataFile when bootstrap is configured", vmKey(vm))
+		}
+		if cfg.Bootstrap.StorageAccountName != "" && vm.OsDiskCreateOption == "Attach" {
+			return nil, fmt.Errorf("vm %q attaches an os disk, which can't be bootstrapped from the bootstrap share", vmKey(vm))
+		}
+
+		// Ensure the VM's extension settings serialize as JSON, the form Azure receives them in.
+		for _, extension := range vm.Extensions {
+			if _, err := json.Marshal(extension.Settings); err != nil {
+				return nil, fmt.Errorf("vm %q extension %q settings are not valid json: %w", vmKey(vm), extension.Name, err)
 			}
-			ctx.Export("pipMap", pipMapOutput)
-		*/
+		}
 
-		// Create NICs.
-		nicMap := make(map[string]*network.NetworkInterface)
-		nicResources := []pulumi.Resource{}
+		// Ensure the Public IPs attached to the VM are compatible with the VM's availability zone.
+		if err := validateZones(vm, vnet); err != nil {
+			return nil, err
+		}
+
+		// Ensure accelerated networking is only enabled on NICs attached to a VM size that supports it.
 		for _, nic := range vnet.NIC {
-			ipConfigArgs := &network.NetworkInterfaceIPConfigurationArgs{
-				Name: pulumi.String("ipconfig"),
-				Subnet: &network.SubnetTypeArgs{
-					Id: snetMap[nic.SnetName].ID(),
-				},
+			if !nic.EnableAcceleratedNetworking || !slices.Contains(nicMapNames(vm.NicMap), nic.Name) {
+				continue
 			}
-
-			// Check if pipMap contains the nic.PipName
-			if pip, exists := pipMap[nic.PipName]; exists {
-				ipConfigArgs.PublicIPAddress = &network.PublicIPAddressTypeArgs{
-					Id: pip.ID(),
-				}
+			if !acceleratedNetworkingVmSizes[strings.ToLower(vm.VmSize)] {
+				return nil, fmt.Errorf("nic %q enables accelerated networking, but vm %q size %q does not support it; disable it on the nic, choose a supported size, or add the size to acceleratedNetworkingVmSizes", nic.Name, vmKey(vm), vm.VmSize)
 			}
+		}
 
-			nicResource, err := network.NewNetworkInterface(ctx, "nic-"+nic.Name+"-"+nameSuffix, &network.NetworkInterfaceArgs{
-				EnableAcceleratedNetworking: pulumi.Bool(nic.EnableAcceleratedNetworking),
-				EnableIPForwarding:          pulumi.Bool(nic.EnableIPForwarding),
-				NicType:                     pulumi.String("Standard"),
-				IpConfigurations: network.NetworkInterfaceIPConfigurationArray{
-					*ipConfigArgs,
-				},
-				ResourceGroupName: resourceGroup.Name,
-				Tags:              requiredTags,
-			},
-				pulumi.DependsOn(pipResources),
-				pulumi.Parent(resourceGroup),
-			)
-			if err != nil {
-				return err
+		for _, nicName := range nicMapNames(vm.NicMap) {
+			if owner, exists := nicOwners[nicName]; exists {
+				return nil, fmt.Errorf("nic %q is attached to both vm %q and vm %q", nicName, owner, vmKey(vm))
 			}
-			nicMap[nic.Name] = nicResource
-			nicResources = append(nicResources, nicResource)
+			nicOwners[nicName] = vmKey(vm)
 		}
+	}
 
-		/*
-			// Export the pipMap to a stack output. For debugging.
-			nicMapOutput := pulumi.StringMap{}
-			for key, nic := range nicMap {
-				nicMapOutput[key] = nic.ID().ToStringOutput()
-			}
-			ctx.Export("nicMap", nicMapOutput)
-		*/
+	// Define whether to protect the resource group, VMs and OS disk IDs from deletion. It defaults to the preset's.
+	protectResources := preset.ProtectResources
+	if cfg.ProtectResources != nil {
+		protectResources = *cfg.ProtectResources
+	}
 
-		// Create a random ID for the OS disk
-		randomOsDiskId, err := random.NewRandomString(ctx, "random-os-disk-id", &random.RandomStringArgs{
-			Length:     pulumi.Int(8),
-			Lower:      pulumi.Bool(true),
-			MinLower:   pulumi.Int(4),
-			MinNumeric: pulumi.Int(4),
-			Numeric:    pulumi.Bool(true),
-			Special:    pulumi.Bool(false),
-			Upper:      pulumi.Bool(false),
-		},
-			pulumi.DependsOn(nicResources),
-		)
-		if err != nil {
-			return err
+	// Ensure the custom timeouts are valid durations.
+	timeouts, err := customTimeouts(cfg.CustomTimeouts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensure an existing resource group is named.
+	if cfg.ResourceGroup.Existing && cfg.ResourceGroup.Name == "" {
+		return nil, fmt.Errorf("resourceGroup.name is required when resourceGroup.existing is set")
+	}
+
+	// Shift the default rules into a reserved range of priorities, so they can't collide with the NSGs' own rules.
+	base := cfg.DefaultRulesPriorityBase
+	if len(cfg.DefaultRules) > 0 && (base < 100 || base > 4096) {
+		return nil, fmt.Errorf("defaultRulesPriorityBase must be between 100 and 4096, got %d", base)
+	}
+	var defaultRules []Rule
+	reservedPriorities := base
+	for _, rule := range cfg.DefaultRules {
+		if rule.Priority < 0 || base+rule.Priority > 4096 {
+			return nil, fmt.Errorf("default rule %q priority %d is an offset from defaultRulesPriorityBase %d, so must be between 0 and %d", rule.Name, rule.Priority, base, 4096-base)
 		}
+		rule.Priority += base
+		defaultRules = append(defaultRules, rule)
+		reservedPriorities = max(reservedPriorities, rule.Priority)
+	}
 
-		// Create a virtual machine.
-		virtualMachine, err := compute.NewVirtualMachine(ctx, "vm-"+tags.Solution+"-prod-", &compute.VirtualMachineArgs{
-			HardwareProfile: compute.HardwareProfileArgs{
-				VmSize: pulumi.String(vm.VmSize),
-			},
-			NetworkProfile: compute.NetworkProfileArgs{
-				NetworkInterfaces: compute.NetworkInterfaceReferenceArray{
-					compute.NetworkInterfaceReferenceArgs{
-						Id:      nicMap[vm.NicMap.Nic0].ID(),
-						Primary: pulumi.Bool(true),
-					},
-					compute.NetworkInterfaceReferenceArgs{
-						Id:      nicMap[vm.NicMap.Nic1].ID(),
-						Primary: pulumi.Bool(false),
-					},
-					compute.NetworkInterfaceReferenceArgs{
-						Id:      nicMap[vm.NicMap.Nic2].ID(),
-						Primary: pulumi.Bool(false),
-					},
-				},
-			},
-			OsProfile: compute.OSProfileArgs{
-				AdminPassword:            pulumi.String(vm.AdminPassword),
-				AdminUsername:            pulumi.String(vm.AdminUsername),
-				AllowExtensionOperations: pulumi.Bool(true),
-				ComputerName:             pulumi.String(vm.ComputerName),
-				LinuxConfiguration: compute.LinuxConfigurationArgs{
-					DisablePasswordAuthentication: pulumi.Bool(false),
-					EnableVMAgentPlatformUpdates:  pulumi.Bool(true),
-					ProvisionVMAgent:              pulumi.Bool(true),
-				},
-			},
-			Plan: &compute.PlanArgs{
-				Name:      pulumi.String(vm.Image.Sku),
-				Product:   pulumi.String(vm.Image.Offer),
-				Publisher: pulumi.String(vm.Image.Publisher),
-			},
-			ResourceGroupName: resourceGroup.Name,
-			StorageProfile: compute.StorageProfileArgs{
-				ImageReference: compute.ImageReferenceArgs{
-					Offer:     pulumi.String(vm.Image.Offer),
-					Publisher: pulumi.String(vm.Image.Publisher),
-					Sku:       pulumi.String(vm.Image.Sku),
-					Version:   pulumi.String(vm.Image.Version),
-				},
-				OsDisk: compute.OSDiskArgs{
-					Caching:      compute.CachingTypesReadWrite,
-					CreateOption: pulumi.String("FromImage"),
-					DeleteOption: pulumi.String("Delete"),
-					DiskSizeGB:   pulumi.Int(127),
-					ManagedDisk: compute.ManagedDiskParametersArgs{
-						StorageAccountType: pulumi.String(vm.StorageAccountType),
-					},
-					Name: pulumi.Sprintf("os-%s%s", nameSuffix, randomOsDiskId.Result),
-				},
-			},
-			Tags: requiredTags,
-		},
-			pulumi.DependsOn(append(nicResources, randomOsDiskId)),
-			pulumi.Parent(resourceGroup),
-		)
-		ctx.Value(virtualMachine)
-		if err != nil {
-			return err
+	// Add the default rules to every NSG that doesn't skip them, and validate each NSG's rules and flow log.
+	for i, nsg := range vnet.NSG {
+		var errs []error
+		if !nsg.SkipDefaultRules && len(defaultRules) > 0 {
+			for _, rule := range nsg.Rules {
+				if rule.Priority <= reservedPriorities {
+					errs = append(errs, fmt.Errorf("nsg %q rule %q priority %d must be above %d, as %d-%d is reserved for default rules", nsg.Name, rule.Name, rule.Priority, reservedPriorities, base, reservedPriorities))
+				}
+			}
+			nsg.Rules = append(slices.Clone(defaultRules), nsg.Rules...)
+		}
+		if err := errors.Join(append(errs, validateSecurityRules(nsg, vnet.ASG))...); err != nil {
+			return nil, err
+		}
+		if nsg.FlowLog.Enabled {
+			if nsg.FlowLog.RetentionDays < 0 || nsg.FlowLog.RetentionDays > 365 {
+				return nil, fmt.Errorf("nsg %q flow log retentionDays %d is outside the allowed range of 0-365", nsg.Name, nsg.FlowLog.RetentionDays)
+			}
+			if nsg.FlowLog.StorageAccountId == "" {
+				return nil, fmt.Errorf("nsg %q flow log requires storageAccountId to be set", nsg.Name)
+			}
+			if nsg.FlowLog.NetworkWatcherName == "" && cfg.Location == "" && !cfg.ResourceGroup.Existing {
+				return nil, fmt.Errorf("nsg %q flow log requires networkWatcherName or location to be set", nsg.Name)
+			}
 		}
+		vnet.NSG[i] = nsg
+	}
 
-		return nil
-	})
-}
+	// Ensure every route is valid for its next hop type.
+	for _, rt := range vnet.RT {
+		for _, route := range rt.Routes {
+			if err := validateRoute(rt, route); err != nil {
+				return nil, err
+			}
+		}
+	}
 
+	// Ensure the virtual network's address spaces and encryption are valid.
+	if err := validateAddressSpaces(vnet); err != nil {
+		return nil, err
+	}
+	if err := validateEncryption(vnet); err != nil {
+		return nil, err
+	}
+
+	// Ensure existing Public IPs have an ID, and that the Public IPs this stack creates are valid.
+	for _, pip := range vnet.PIP {
+		if err := validateExisting("public ip", pip.Name, pip.Existing, pip.Id, publicIpAddressIdPattern); err != nil {
+			return nil, err
+		}
+		if pip.Existing {
+			continue
+		}
+		if err := validatePublicIP(pip); err != nil {
+			return nil, err
+		}
+	}
+
+	// Ensure each NAT Gateway references a Standard, IPv4 Public IP.
+	for _, natGateway := range vnet.NATGW {
+		index := slices.IndexFunc(vnet.PIP, func(pip PIP) bool { return pip.Name == natGateway.PipName })
+		if index < 0 {
+			return nil, fmt.Errorf("nat gateway %q references unknown public ip %q", natGateway.Name, natGateway.PipName)
+		}
+		if valueOrDefault(vnet.PIP[index].SkuName, "Standard") != "Standard" {
+			return nil, fmt.Errorf("nat gateway %q requires public ip %q to use the Standard sku", natGateway.Name, natGateway.PipName)
+		}
+		if valueOrDefault(vnet.PIP[index].Version, "IPv4") != "IPv4" {
+			return nil, fmt.Errorf("nat gateway %q requires public ip %q to be IPv4", natGateway.Name, natGateway.PipName)
+		}
+	}
+
+	// Ensure existing subnets only set an ID, and that the subnets this stack creates are valid.
+	for _, snet := range vnet.SNET {
+		if err := validateExisting("subnet", snet.Name, snet.Existing, snet.Id, subnetIdPattern); err != nil {
+			return nil, err
+		}
+		if snet.Existing {
+			if snet.AddressPrefix != "" || len(snet.AddressPrefixes) > 0 || snet.NSGName != "" || snet.RTName != "" || snet.NatGatewayName != "" {
+				return nil, fmt.Errorf("subnet %q is existing, so cannot set addressPrefix, addressPrefixes, nsgName, rtName or natGatewayName", snet.Name)
+			}
+			continue
+		}
+		if err := validateSubnetAddressPrefixes(snet); err != nil {
+			return nil, err
+		}
+		if err := validateDefaultOutboundAccess(snet, vnet); err != nil {
+			return nil, err
+		}
+		if !slices.Contains([]string{"", "Enabled", "Disabled"}, snet.PrivateEndpointNetworkPolicies) {
+			return nil, fmt.Errorf("subnet %q has unknown privateEndpointNetworkPolicies %q, expected Enabled or Disabled", snet.Name, snet.PrivateEndpointNetworkPolicies)
+		}
+		if !slices.Contains([]string{"", "Enabled", "Disabled"}, snet.PrivateLinkServiceNetworkPolicies) {
+			return nil, fmt.Errorf("subnet %q has unknown privateLinkServiceNetworkPolicies %q, expected Enabled or Disabled", snet.Name, snet.PrivateLinkServiceNetworkPolicies)
+		}
+		if snet.NSGName != "" && !slices.ContainsFunc(vnet.NSG, func(nsg NSG) bool { return nsg.Name == snet.NSGName }) {
+			return nil, fmt.Errorf("subnet %q references unknown network security group %q", snet.Name, snet.NSGName)
+		}
+		if snet.RTName != "" && !slices.ContainsFunc(vnet.RT, func(rt RT) bool { return rt.Name == snet.RTName }) {
+			return nil, fmt.Errorf("subnet %q references unknown route table %q", snet.Name, snet.RTName)
+		}
+		if snet.NatGatewayName != "" && !slices.ContainsFunc(vnet.NATGW, func(natGateway NATGW) bool { return natGateway.Name == snet.NatGatewayName }) {
+			return nil, fmt.Errorf("subnet %q references unknown nat gateway %q", snet.Name, snet.NatGatewayName)
+		}
+	}
+
+	// Ensure each peering references a virtual network ID.
+	for _, peering := range vnet.Peerings {
+		if !virtualNetworkIdPattern.MatchString(peering.RemoteVirtualNetworkId) {
+			return nil, fmt.Errorf("peering %q has invalid remoteVirtualNetworkId %q", peering.Name, peering.RemoteVirtualNetworkId)
+		}
+	}
+
+	// Ensure the load balancers are valid and don't share a name.
+	if vnet.LoadBalancer.Name != "" {
+		if err := validateLoadBalancer(vnet.LoadBalancer, vnet); err != nil {
+			return nil, err
+		}
+	}
+	haPair := cfg.HaPair
+	if !cfg.DeployVM {
+		haPair = HaPair{}
+	}
+	if haPair.Name != "" {
+		if err := validateHaPair(haPair, vms, vnet); err != nil {
+			return nil, err
+		}
+		if haPair.Name == vnet.LoadBalancer.Name {
+			return nil, fmt.Errorf("ha pair %q cannot share its name with load balancer %q", haPair.Name, vnet.LoadBalancer.Name)
+		}
+	}
+	if outboundRule := vnet.OutboundRule; outboundRule.Name != "" {
+		if err := validateOutboundRule(outboundRule, vnet); err != nil {
+			return nil, err
+		}
+		if outboundRule.Name == vnet.LoadBalancer.Name || outboundRule.Name == haPair.Name {
+			return nil, fmt.Errorf("outbound rule %q cannot share its name with another load balancer", outboundRule.Name)
+		}
+	}
+
+	// Ensure every Application Security Group referenced by a NIC exists.
+	for _, nic := range vnet.NIC {
+		for _, asgName := range nic.ApplicationSecurityGroups {
+			if !slices.ContainsFunc(vnet.ASG, func(asg ASG) bool { return asg.Name == asgName }) {
+				return nil, fmt.Errorf("nic %q references unknown application security group %q", nic.Name, asgName)
+			}
+		}
+	}
+
+	// Ensure NIC types, auxiliary modes and DNS servers are valid.
+	for _, nic := range vnet.NIC {
+		if !slices.Contains([]string{"", "None", "MaxConnections", "Floating", "AcceleratedConnections"}, nic.AuxiliaryMode) {
+			return nil, fmt.Errorf("nic %q has unknown auxiliaryMode %q, expected None, MaxConnections, Floating or AcceleratedConnections", nic.Name, nic.AuxiliaryMode)
+		}
+		if !slices.Contains([]string{"", "None", "A1", "A2", "A4", "A8"}, nic.AuxiliarySku) {
+			return nil, fmt.Errorf("nic %q has unknown auxiliarySku %q, expected None, A1, A2, A4 or A8", nic.Name, nic.AuxiliarySku)
+		}
+		auxiliaryMode := nic.AuxiliaryMode != "" && nic.AuxiliaryMode != "None"
+		auxiliarySku := nic.AuxiliarySku != "" && nic.AuxiliarySku != "None"
+		if auxiliaryMode && !nic.EnableAcceleratedNetworking {
+			return nil, fmt.Errorf("nic %q uses auxiliaryMode %s, which requires enableAcceleratedNetworking", nic.Name, nic.AuxiliaryMode)
+		}
+		if auxiliaryMode != auxiliarySku {
+			return nil, fmt.Errorf("nic %q must set auxiliaryMode and auxiliarySku together", nic.Name)
+		}
+
+		// Disabling TCP state tracking is only supported with accelerated networking.
+		if nic.DisableTcpStateTracking && !nic.EnableAcceleratedNetworking {
+			return nil, fmt.Errorf("nic %q disables tcp state tracking, which requires enableAcceleratedNetworking", nic.Name)
+		}
+
+		switch nic.NicType {
+		case "", "Standard", "Elastic":
+		default:
+			return nil, fmt.Errorf("nic %q has unknown nicType %q, expected Standard or Elastic", nic.Name, nic.NicType)
+		}
+		for _, dnsServer := range nic.DnsServers {
+			if dnsServer == "AzureProvidedDNS" {
+				continue
+			}
+			if _, err := netip.ParseAddr(dnsServer); err != nil {
+				return nil, fmt.Errorf("nic %q has invalid dns server %q: %w", nic.Name, dnsServer, err)
+			}
+		}
+	}
+
+	// Ensure the Application Gateway, Bastion host and bootstrap share are valid.
+	if agw := vnet.ApplicationGateway; agw.Name != "" {
+		if err := validateApplicationGateway(agw, vnet); err != nil {
+			return nil, err
+		}
+		if haPair.Name != "" && haPair.FrontendSnetName == agw.SnetName {
+			return nil, fmt.Errorf("application gateway %q requires a dedicated subnet, but subnet %q is the frontend of ha pair %q", agw.Name, agw.SnetName, haPair.Name)
+		}
+	}
+	if vnet.Bastion.Name != "" {
+		if err := validateBastion(vnet.Bastion, vnet); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Bootstrap.StorageAccountName != "" {
+		if err := validateBootstrap(cfg.Bootstrap, vnet); err != nil {
+			return nil, err
+		}
+	}
+
+	// Define the marketplace plans whose terms are accepted, if acceptMarketplaceTerms is set.
+	var marketplaceAgreements []ImagePlan
+	if cfg.AcceptMarketplaceTerms {
+		marketplaceAgreements, err = marketplaceAgreementPlans(vms)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Warn about virtual appliance next hop NICs without IP forwarding, as they drop the traffic routed to them.
+	var warnings []string
+	for _, rt := range vnet.RT {
+		for _, route := range rt.Routes {
+			if route.NextHopType != "VirtualAppliance" {
+				continue
+			}
+			for _, nic := range vnet.NIC {
+				for _, ipConfig := range nic.IpConfigurations {
+					if ipConfig.PrivateIpAddress != "" && ipConfig.PrivateIpAddress == route.NextHopIpAddress && !nic.EnableIPForwarding {
+						warnings = append(warnings, fmt.Sprintf("nic %q is the next hop for route %q in route table %q, but does not have enableIPForwarding set", nic.Name, route.Name, rt.Name))
+					}
+				}
+			}
+		}
+	}
+
+	// Ensure each Public IP with a dnsRecordName has a DNS zone to hold its A record, and a valid record name.
+	for _, pip := range vnet.PIP {
+		if pip.DnsRecordName == "" {
+			continue
+		}
+		if cfg.DnsZone.Name == "" || cfg.DnsZone.ResourceGroupName == "" {
+			return nil, fmt.Errorf("public ip %q dnsRecordName requires dnsZone.name and dnsZone.resourceGroupName to be set", pip.Name)
+		}
+		if pip.DnsRecordName != "@" && !isHostname(pip.DnsRecordName) {
+			return nil, fmt.Errorf("public ip %q dnsRecordName %q is not a valid record name", pip.Name, pip.DnsRecordName)
+		}
+		if valueOrDefault(pip.Version, "IPv4") != "IPv4" {
+			return nil, fmt.Errorf("public ip %q dnsRecordName requires an IPv4 public ip for its A record", pip.Name)
+		}
+	}
+	if cfg.DnsZone.Ttl < 0 {
+		return nil, fmt.Errorf("dnsZone ttl %d must not be negative", cfg.DnsZone.Ttl)
+	}
+
+	// Warn when a deployment batch is configured without tagging, as it would otherwise be silently ignored.
+	if cfg.DeploymentBatch != "" && !cfg.TagDeploymentBatch {
+		warnings = append(warnings, "deploymentBatch is set, but tagDeploymentBatch is not, so resources are not tagged with it")
+	}
+
+	return &Plan{
+		Bootstrap:                cfg.Bootstrap,
+		DeploymentBatch:          cfg.DeploymentBatch,
+		DeployVM:                 cfg.DeployVM,
+		DiagnosticSettings:       cfg.DiagnosticSettings,
+		DnsZone:                  cfg.DnsZone,
+		FlatHierarchy:            cfg.FlatHierarchy,
+		HaPair:                   haPair,
+		IgnoreTagChanges:         cfg.IgnoreTagChanges,
+		InheritResourceGroupTags: cfg.InheritResourceGroupTags,
+		Location:                 cfg.Location,
+		LoggingVolumes:           loggingVolumes,
+		MarketplaceAgreements:    marketplaceAgreements,
+		NameSuffix:               nameSuffix,
+		OsDiskIdLength:           cfg.OsDiskIdLength,
+		OsDiskIdUpper:            cfg.OsDiskIdUpper,
+		PinLatest:                cfg.PinLatest,
+		ProtectResources:         protectResources,
+		RandomizeNames:           cfg.RandomizeNames,
+		ResourceCounts:           summarizeResources(vnet, vms),
+		ResourceGroup:            cfg.ResourceGroup,
+		ResourceManagerEndpoint:  cmp.Or(cfg.ResourceManagerEndpoint, resourceManagerEndpoints["public"]),
+		TagDeploymentBatch:       cfg.TagDeploymentBatch,
+		Tags:                     tags,
+		Timeouts:                 timeouts,
+		VMs:                      vms,
+		VNET:                     vnet,
+		Warnings:                 warnings,
+	}, nil
+}
+
+// apply creates the resources of a plan. The plan is already validated, so apply only fails on errors from Pulumi or
+// Azure.
+func apply(ctx *pulumi.Context, plan *Plan) error {
+	// Log the plan's warnings, for settings that are valid but likely mistakes.
+	for _, warning := range plan.Warnings {
+		ctx.Log.Warn(warning, nil)
+	}
+
+	// Export each VM's logging volume layout, for an in-guest script to stripe its disks into one volume.
+	loggingVolumes := pulumi.Map{}
+	for name, layout := range plan.LoggingVolumes {
+		loggingVolumes[name] = pulumi.Map{
+			"caching":    pulumi.String(layout.Caching),
+			"diskSizeGB": pulumi.Int(layout.DiskSizeGB),
+			"luns":       pulumi.ToIntArray(layout.Luns),
+		}
+	}
+	ctx.Export("loggingVolumes", loggingVolumes)
+
+	// Export how many of each main resource the configuration expands to, as a sanity check during preview.
+	ctx.Export("resourceCounts", pulumi.IntMap{
+		"nics":        pulumi.Int(plan.ResourceCounts.NICs),
+		"nsgs":        pulumi.Int(plan.ResourceCounts.NSGs),
+		"publicIps":   pulumi.Int(plan.ResourceCounts.PublicIPs),
+		"routeTables": pulumi.Int(plan.ResourceCounts.RouteTables),
+		"subnets":     pulumi.Int(plan.ResourceCounts.Subnets),
+		"vms":         pulumi.Int(plan.ResourceCounts.VMs),
+	})
+
+	// Register the stack transformations before any resources are created.
+	if err := registerStackTransformations(ctx, plan); err != nil {
+		return err
+	}
+
+	// Define required tags for the project.
+	d := &deployment{
+		ctx:      ctx,
+		location: plan.Location,
+		plan:     plan,
+		requiredTags: pulumi.StringMap{
+			"automation": pulumi.String(plan.Tags.Automation),
+			"solution":   pulumi.String(plan.Tags.Solution),
+		},
+		vmSummaries: pulumi.Map{},
+	}
+
+	// Create a shared random suffix for Azure resource names, if enabled. Its inputs must never change.
+	if plan.RandomizeNames {
+		randomNameSuffix, err := random.NewRandomString(ctx, "random-name-suffix", &random.RandomStringArgs{
+			Length:  pulumi.Int(autonameSuffixLength),
+			Lower:   pulumi.Bool(true),
+			Numeric: pulumi.Bool(true),
+			Special: pulumi.Bool(false),
+			Upper:   pulumi.Bool(false),
+		})
+		if err != nil {
+			return err
+		}
+		d.randomNameSuffix = randomNameSuffix
+	}
+
+	// Create the network.
+	if err := d.createResourceGroup(); err != nil {
+		return err
+	}
+	if err := d.createSecurityGroups(); err != nil {
+		return err
+	}
+	if err := d.createRouteTables(); err != nil {
+		return err
+	}
+	if err := d.createVirtualNetwork(); err != nil {
+		return err
+	}
+	if err := d.createPublicIps(); err != nil {
+		return err
+	}
+	if err := d.createNatGateways(); err != nil {
+		return err
+	}
+	if err := d.createSubnets(); err != nil {
+		return err
+	}
+
+	// Create the load balancers, then the NICs in their backend pools.
+	if err := d.createLoadBalancer(); err != nil {
+		return err
+	}
+	if err := d.createHaLoadBalancer(); err != nil {
+		return err
+	}
+	if err := d.createOutboundLoadBalancer(); err != nil {
+		return err
+	}
+	if err := d.createNetworkInterfaces(); err != nil {
+		return err
+	}
+	if err := d.createApplicationGateway(); err != nil {
+		return err
+	}
+	if err := d.createBastionHost(); err != nil {
+		return err
+	}
+
+	// Create the VMs, after their bootstrap storage and marketplace agreements.
+	bootstrapCustomData, err := d.createBootstrapStorage()
+	if err != nil {
+		return err
+	}
+	marketplaceAgreements, err := d.acceptMarketplaceTerms()
+	if err != nil {
+		return err
+	}
+	if err := d.createVirtualMachines(bootstrapCustomData, marketplaceAgreements); err != nil {
+		return err
+	}
+
+	d.exportSummary()
+	return nil
+}
+
+// deployment holds the state apply's resource families share: the plan, the resource group, the resources later families
+// reference, and the inventory of everything created.
+type deployment struct {
+	ctx              *pulumi.Context
+	plan             *Plan
+	location         string
+	requiredTags     pulumi.StringMap
+	randomNameSuffix *random.RandomString
+	resourceGroup    *resources.ResourceGroup
+
+	asgMap         map[string]*network.ApplicationSecurityGroup
+	nsgMap         map[string]*network.NetworkSecurityGroup
+	rtMap          map[string]*network.RouteTable
+	virtualNetwork *network.VirtualNetwork
+	pipMap         map[string]*network.PublicIPAddress
+	natGatewayMap  map[string]*network.NatGateway
+	snetMap        map[string]*networkv20240501.Subnet
+	backendPools   []backendPool
+	nicMap         map[string]*network.NetworkInterface
+	vmSummaries    pulumi.Map
+
+	inventoryTypes []string
+	inventoryIds   []interface{}
+}
+
+// backendPool is a load balancer's backend pool, and the NICs whose primary IP configurations are its members.
+type backendPool struct {
+	loadBalancer *network.LoadBalancer
+	id           pulumi.StringOutput
+	nics         map[string]bool
+}
+
+// childTags returns the tags of the resource group's children, which only get the required tags when they are inherited.
+func (d *deployment) childTags(extra map[string]string) pulumi.StringMap {
+	if !d.plan.InheritResourceGroupTags {
+		return mergeTags(nil, extra)
+	}
+	return mergeTags(d.requiredTags, extra)
+}
+
+// parentOf parents a resource under another, or with flatHierarchy only makes it depend on the other. URNs include the
+// parent chain, so changing flatHierarchy on a deployed stack replaces every resource.
+func (d *deployment) parentOf(parent pulumi.Resource) pulumi.ResourceOption {
+	if d.plan.FlatHierarchy {
+		return pulumi.DependsOn([]pulumi.Resource{parent})
+	}
+	return pulumi.Parent(parent)
+}
+
+// addInventory records a created Azure resource and its type for the exported inventory. Existing resources that are only
+// read are left out.
+func (d *deployment) addInventory(resourceType string, resource pulumi.CustomResource) {
+	d.inventoryTypes = append(d.inventoryTypes, resourceType)
+	d.inventoryIds = append(d.inventoryIds, resource.ID())
+}
+
+// registerStackTransformations ignores tag changes on every Azure resource, if ignoreTagChanges is set, and tags each with
+// the deployment batch, if tagDeploymentBatch is set.
+func registerStackTransformations(ctx *pulumi.Context, plan *Plan) error {
+	// Ignore tag changes for environments where tags are managed by Azure Policy.
+	if plan.IgnoreTagChanges {
+		err := ctx.RegisterStackTransformation(func(args *pulumi.ResourceTransformationArgs) *pulumi.ResourceTransformationResult {
+			if !strings.HasPrefix(args.Type, "azure-native:") {
+				return nil
+			}
+			return &pulumi.ResourceTransformationResult{
+				Props: args.Props,
+				Opts:  append(args.Opts, pulumi.IgnoreChanges([]string{"tags"})),
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tag resources with the configured deploymentBatch, or an ID that is new on every run, so a failed run's leftovers can be found.
+	if plan.TagDeploymentBatch {
+		deploymentBatch := plan.DeploymentBatch
+		if deploymentBatch == "" {
+			batchBytes := make([]byte, 4)
+			if _, err := rand.Read(batchBytes); err != nil {
+				return fmt.Errorf("failed to generate deployment batch id: %w", err)
+			}
+			deploymentBatch = hex.EncodeToString(batchBytes)
+		}
+		err := ctx.RegisterStackTransformation(func(args *pulumi.ResourceTransformationArgs) *pulumi.ResourceTransformationResult {
+			if !strings.HasPrefix(args.Type, "azure-native:") {
+				return nil
+			}
+			return &pulumi.ResourceTransformationResult{
+				Props: withTag(args.Props, "deployment-batch", deploymentBatch),
+				Opts:  args.Opts,
+			}
+		})
+		if err != nil {
+			return err
+		}
+		ctx.Export("deploymentBatch", pulumi.String(deploymentBatch))
+	}
+	return nil
+}
+
+// createResourceGroup creates the resource group, or reads the existing one configured by resourceGroup.existing and
+// resourceGroup.name, whose location is used when none is configured.
+func (d *deployment) createResourceGroup() error {
+	ctx, plan := d.ctx, d.plan
+	logicalName := resourceName(plan.NameSuffix, "rg", "")
+
+	// Read an existing, pre-created resource group, if configured.
+	if plan.ResourceGroup.Existing {
+		existingResourceGroup, err := resources.LookupResourceGroup(ctx, &resources.LookupResourceGroupArgs{
+			ResourceGroupName: plan.ResourceGroup.Name,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to look up existing resource group %q: %w", plan.ResourceGroup.Name, err)
+		}
+		if d.location == "" {
+			d.location = existingResourceGroup.Location
+		}
+		d.resourceGroup, err = resources.GetResourceGroup(ctx, logicalName, pulumi.ID(existingResourceGroup.Id), nil)
+		if err != nil {
+			return fmt.Errorf("failed to read existing resource group %q: %w", plan.ResourceGroup.Name, err)
+		}
+		return nil
+	}
+
+	// Create an Azure Resource Group.
+	resourceGroupName := randomizedName(logicalName, d.randomNameSuffix)
+	if plan.ResourceGroup.Name != "" {
+		resourceGroupName = pulumi.String(plan.ResourceGroup.Name)
+	}
+	resourceGroup, err := resources.NewResourceGroup(ctx, logicalName, &resources.ResourceGroupArgs{
+		Location:          stringPtr(d.location),
+		ResourceGroupName: resourceGroupName,
+		Tags:              d.requiredTags,
+	},
+		pulumi.Protect(plan.ProtectResources),
+	)
+	if err != nil {
+		return err
+	}
+	d.resourceGroup = resourceGroup
+	d.addInventory("Microsoft.Resources/resourceGroups", resourceGroup)
+	return nil
+}
+
+// createSecurityGroups creates the application security groups, then the NSGs with their rules, which already include the
+// default rules, and flow logs.
+func (d *deployment) createSecurityGroups() error {
+	ctx, nameSuffix, resourceGroup := d.ctx, d.plan.NameSuffix, d.resourceGroup
+
+	// Create Application Security Groups.
+	d.asgMap = make(map[string]*network.ApplicationSecurityGroup)
+	for _, asg := range d.plan.VNET.ASG {
+		asgResource, err := network.NewApplicationSecurityGroup(ctx, resourceName(nameSuffix, "asg", asg.Name), &network.ApplicationSecurityGroupArgs{
+			ApplicationSecurityGroupName: randomizedName(resourceName(nameSuffix, "asg", asg.Name), d.randomNameSuffix),
+			Location:                     stringPtr(d.location),
+			ResourceGroupName:            resourceGroup.Name,
+			Tags:                         d.childTags(asg.Tags),
+		},
+			pulumi.DependsOn([]pulumi.Resource{resourceGroup}),
+			d.parentOf(resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.asgMap[asg.Name] = asgResource
+		d.addInventory("Microsoft.Network/applicationSecurityGroups", asgResource)
+	}
+	exportIds(ctx, "asg", d.asgMap)
+
+	// Create Network Security Groups and Security Rules.
+	d.nsgMap = make(map[string]*network.NetworkSecurityGroup)
+	for _, nsg := range d.plan.VNET.NSG {
+		// Order the rules by direction and priority, so reordering them in config doesn't cause a diff.
+		rules := slices.Clone(nsg.Rules)
+		slices.SortStableFunc(rules, func(a, b Rule) int {
+			return cmp.Or(strings.Compare(strings.ToLower(a.Direction), strings.ToLower(b.Direction)), cmp.Compare(a.Priority, b.Priority))
+		})
+		var securityRules network.SecurityRuleTypeArray
+		for _, rule := range rules {
+			securityRules = append(securityRules, securityRuleArgs(rule, d.asgMap))
+		}
+
+		nsgResource, err := network.NewNetworkSecurityGroup(ctx, resourceName(nameSuffix, "nsg", nsg.Name), &network.NetworkSecurityGroupArgs{
+			Location:                 stringPtr(d.location),
+			NetworkSecurityGroupName: randomizedName(resourceName(nameSuffix, "nsg", nsg.Name), d.randomNameSuffix),
+			ResourceGroupName:        resourceGroup.Name,
+			SecurityRules:            securityRules,
+			Tags:                     d.childTags(nsg.Tags),
+		},
+			pulumi.DependsOn([]pulumi.Resource{resourceGroup}),
+			d.parentOf(resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.nsgMap[nsg.Name] = nsgResource
+		d.addInventory("Microsoft.Network/networkSecurityGroups", nsgResource)
+
+		// Create an NSG flow log in the regional Network Watcher, if enabled. It defaults to the one Azure creates.
+		if nsg.FlowLog.Enabled {
+			networkWatcherName := valueOrDefault(nsg.FlowLog.NetworkWatcherName, "NetworkWatcher_"+d.location)
+			networkWatcherResourceGroup := valueOrDefault(nsg.FlowLog.NetworkWatcherResourceGroup, "NetworkWatcherRG")
+
+			flowLog, err := network.NewFlowLog(ctx, resourceName(nameSuffix, "fl", nsg.Name), &network.FlowLogArgs{
+				Enabled:            pulumi.Bool(true),
+				FlowLogName:        randomizedName(resourceName(nameSuffix, "fl", nsg.Name), d.randomNameSuffix),
+				Location:           stringPtr(d.location),
+				NetworkWatcherName: pulumi.String(networkWatcherName),
+				ResourceGroupName:  pulumi.String(networkWatcherResourceGroup),
+				RetentionPolicy: &network.RetentionPolicyParametersArgs{
+					Days:    pulumi.Int(nsg.FlowLog.RetentionDays),
+					Enabled: pulumi.Bool(nsg.FlowLog.RetentionDays > 0),
+				},
+				StorageId:        pulumi.String(nsg.FlowLog.StorageAccountId),
+				Tags:             d.childTags(nil),
+				TargetResourceId: nsgResource.ID(),
+			},
+				pulumi.DependsOn([]pulumi.Resource{nsgResource}),
+				d.parentOf(nsgResource),
+			)
+			if err != nil {
+				return err
+			}
+			d.addInventory("Microsoft.Network/networkWatchers/flowLogs", flowLog)
+		}
+	}
+	exportIds(ctx, "nsg", d.nsgMap)
+	return nil
+}
+
+// createRouteTables creates the route tables and their routes.
+func (d *deployment) createRouteTables() error {
+	ctx, nameSuffix, resourceGroup := d.ctx, d.plan.NameSuffix, d.resourceGroup
+
+	// Create Route Tables and Routes.
+	d.rtMap = make(map[string]*network.RouteTable)
+	for _, rt := range d.plan.VNET.RT {
+		var routes network.RouteTypeArray
+		for _, route := range rt.Routes {
+			routes = append(routes, network.RouteTypeArgs{
+				AddressPrefix:    pulumi.String(route.AddressPrefix),
+				Name:             pulumi.String(route.Name),
+				NextHopType:      pulumi.String(route.NextHopType),
+				NextHopIpAddress: pulumi.String(route.NextHopIpAddress),
+			})
+		}
+
+		rtResource, err := network.NewRouteTable(ctx, resourceName(nameSuffix, "rt", rt.Name), &network.RouteTableArgs{
+			DisableBgpRoutePropagation: pulumi.Bool(rt.DisableBgpRoutePropagation),
+			Location:                   stringPtr(d.location),
+			ResourceGroupName:          resourceGroup.Name,
+			RouteTableName:             randomizedName(resourceName(nameSuffix, "rt", rt.Name), d.randomNameSuffix),
+			Routes:                     routes,
+			Tags:                       d.childTags(rt.Tags),
+		},
+			pulumi.DependsOn([]pulumi.Resource{resourceGroup}),
+			d.parentOf(resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.rtMap[rt.Name] = rtResource
+		d.addInventory("Microsoft.Network/routeTables", rtResource)
+	}
+	exportIds(ctx, "rt", d.rtMap)
+	return nil
+}
+
+// createVirtualNetwork creates the virtual network, and sends its and the NSGs' logs and metrics to a Log Analytics
+// workspace, if diagnosticSettings.workspaceId is configured.
+func (d *deployment) createVirtualNetwork() error {
+	ctx, vnet, nameSuffix, resourceGroup := d.ctx, d.plan.VNET, d.plan.NameSuffix, d.resourceGroup
+
+	// Encrypt traffic between VMs, if configured.
+	var encryption network.VirtualNetworkEncryptionPtrInput
+	if vnet.Encryption != (Encryption{}) {
+		encryption = &network.VirtualNetworkEncryptionArgs{
+			Enabled:     pulumi.Bool(vnet.Encryption.Enabled),
+			Enforcement: stringPtr(vnet.Encryption.Enforcement),
+		}
+	}
+
+	// Create a virtual network. A dual-stack network lists both its IPv4 and IPv6 ranges.
+	virtualNetwork, err := network.NewVirtualNetwork(ctx, resourceName(nameSuffix, "vnet", ""), &network.VirtualNetworkArgs{
+		AddressSpace: &network.AddressSpaceArgs{
+			AddressPrefixes: pulumi.ToStringArray(virtualNetworkAddressSpaces(vnet)),
+		},
+		Encryption:         encryption,
+		Location:           stringPtr(d.location),
+		ResourceGroupName:  resourceGroup.Name,
+		Tags:               d.childTags(vnet.Tags),
+		VirtualNetworkName: randomizedName(resourceName(nameSuffix, "vnet", ""), d.randomNameSuffix),
+	},
+		pulumi.DependsOn([]pulumi.Resource{resourceGroup}),
+		d.parentOf(resourceGroup),
+	)
+	if err != nil {
+		return err
+	}
+	d.virtualNetwork = virtualNetwork
+	d.addInventory("Microsoft.Network/virtualNetworks", virtualNetwork)
+
+	// Send the virtual network's and NSGs' diagnostics to the workspace, if configured.
+	workspaceId := d.plan.DiagnosticSettings.WorkspaceId
+	if workspaceId == "" {
+		return nil
+	}
+	vnetDiagnosticSetting, err := insights.NewDiagnosticSetting(ctx, resourceName(nameSuffix, "diag", "vnet"), &insights.DiagnosticSettingArgs{
+		Logs: insights.LogSettingsArray{
+			insights.LogSettingsArgs{
+				CategoryGroup: pulumi.String("allLogs"),
+				Enabled:       pulumi.Bool(true),
+			},
+		},
+		Metrics: insights.MetricSettingsArray{
+			insights.MetricSettingsArgs{
+				Category: pulumi.String("AllMetrics"),
+				Enabled:  pulumi.Bool(true),
+			},
+		},
+		ResourceUri: virtualNetwork.ID(),
+		WorkspaceId: pulumi.String(workspaceId),
+	},
+		pulumi.DependsOn([]pulumi.Resource{virtualNetwork}),
+		d.parentOf(resourceGroup),
+	)
+	if err != nil {
+		return err
+	}
+	d.addInventory("Microsoft.Insights/diagnosticSettings", vnetDiagnosticSetting)
+
+	for _, nsg := range vnet.NSG {
+		nsgDiagnosticSetting, err := insights.NewDiagnosticSetting(ctx, resourceName(nameSuffix, "diag", "nsg-"+nsg.Name), &insights.DiagnosticSettingArgs{
+			Logs: insights.LogSettingsArray{
+				insights.LogSettingsArgs{
+					CategoryGroup: pulumi.String("allLogs"),
+					Enabled:       pulumi.Bool(true),
+				},
+			},
+			ResourceUri: d.nsgMap[nsg.Name].ID(),
+			WorkspaceId: pulumi.String(workspaceId),
+		},
+			pulumi.DependsOn([]pulumi.Resource{d.nsgMap[nsg.Name]}),
+			d.parentOf(resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.addInventory("Microsoft.Insights/diagnosticSettings", nsgDiagnosticSetting)
+	}
+	return nil
+}
+
+// createPublicIps creates the Public IPs, or reads existing ones, and an A record in an existing DNS zone for each with a
+// dnsRecordName.
+func (d *deployment) createPublicIps() error {
+	ctx, vnet, nameSuffix, resourceGroup := d.ctx, d.plan.VNET, d.plan.NameSuffix, d.resourceGroup
+
+	// Create Public IP Addesses.
+	d.pipMap = make(map[string]*network.PublicIPAddress)
+	for _, pip := range vnet.PIP {
+		// Read an existing Public IP by ID instead of creating one, for brownfield deployments.
+		if pip.Existing {
+			pipResource, err := network.GetPublicIPAddress(ctx, resourceName(nameSuffix, "pip", pip.Name), pulumi.ID(pip.Id), nil)
+			if err != nil {
+				return fmt.Errorf("failed to read existing public ip %q: %w", pip.Name, err)
+			}
+			d.pipMap[pip.Name] = pipResource
+			continue
+		}
+
+		pipArgs := &network.PublicIPAddressArgs{
+			Location:                 stringPtr(d.location),
+			PublicIPAddressVersion:   stringPtr(pip.Version),
+			PublicIPAllocationMethod: pulumi.String(valueOrDefault(pip.AllocationMethod, "Static")),
+			PublicIpAddressName:      randomizedName(resourceName(nameSuffix, "pip", pip.Name), d.randomNameSuffix),
+			ResourceGroupName:        resourceGroup.Name,
+			Sku: &network.PublicIPAddressSkuArgs{
+				Name: pulumi.String(valueOrDefault(pip.SkuName, "Standard")),
+				Tier: pulumi.String(valueOrDefault(pip.SkuTier, "Regional")),
+			},
+			Tags:  d.childTags(pip.Tags),
+			Zones: stringArray(publicIpZones(pip)),
+		}
+
+		// Keep idle TCP flows open for longer than the 4 minute default, if configured.
+		if pip.IdleTimeoutInMinutes != 0 {
+			pipArgs.IdleTimeoutInMinutes = pulumi.Int(pip.IdleTimeoutInMinutes)
+		}
+
+		// Set the DNS label and reverse FQDN, if configured.
+		if pip.DomainNameLabel != "" {
+			pipArgs.DnsSettings = &network.PublicIPAddressDnsSettingsArgs{
+				DomainNameLabel: pulumi.String(pip.DomainNameLabel),
+				ReverseFqdn:     stringPtr(pip.ReverseFqdn),
+			}
+		}
+
+		pipResource, err := network.NewPublicIPAddress(ctx, resourceName(nameSuffix, "pip", pip.Name), pipArgs,
+			pulumi.DependsOn([]pulumi.Resource{resourceGroup}),
+			d.parentOf(resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.pipMap[pip.Name] = pipResource
+		d.addInventory("Microsoft.Network/publicIPAddresses", pipResource)
+	}
+	exportIds(ctx, "pip", d.pipMap)
+
+	// Look up the DNS zone first, so a missing zone fails before any records are created.
+	dnsZone := d.plan.DnsZone
+	if slices.ContainsFunc(vnet.PIP, func(pip PIP) bool { return pip.DnsRecordName != "" }) {
+		if _, err := network.LookupZone(ctx, &network.LookupZoneArgs{
+			ResourceGroupName: dnsZone.ResourceGroupName,
+			ZoneName:          dnsZone.Name,
+		}); err != nil {
+			return fmt.Errorf("failed to read dns zone %q: %w", dnsZone.Name, err)
+		}
+	}
+
+	// Create an A record for each Public IP with a dnsRecordName.
+	for _, pip := range vnet.PIP {
+		if pip.DnsRecordName == "" {
+			continue
+		}
+		recordSet, err := network.NewRecordSet(ctx, resourceName(nameSuffix, "dns", pip.Name), &network.RecordSetArgs{
+			ARecords: d.pipMap[pip.Name].IpAddress.ApplyT(func(ipAddress *string) []network.ARecord {
+				return []network.ARecord{{Ipv4Address: ipAddress}}
+			}).(network.ARecordArrayOutput),
+			RecordType:            pulumi.String("A"),
+			RelativeRecordSetName: pulumi.String(pip.DnsRecordName),
+			ResourceGroupName:     pulumi.String(dnsZone.ResourceGroupName),
+			Ttl:                   pulumi.Float64(float64(cmp.Or(dnsZone.Ttl, 300))),
+			ZoneName:              pulumi.String(dnsZone.Name),
+		},
+			d.parentOf(resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.addInventory("Microsoft.Network/dnsZones/A", recordSet)
+	}
+	return nil
+}
+
+// createNatGateways creates the NAT gateways giving the subnets that reference them deterministic outbound connectivity.
+func (d *deployment) createNatGateways() error {
+	ctx, nameSuffix := d.ctx, d.plan.NameSuffix
+
+	// Create NAT Gateways.
+	d.natGatewayMap = make(map[string]*network.NatGateway)
+	for _, natGateway := range d.plan.VNET.NATGW {
+		pip := d.pipMap[natGateway.PipName]
+		natGatewayArgs := &network.NatGatewayArgs{
+			Location:       stringPtr(d.location),
+			NatGatewayName: randomizedName(resourceName(nameSuffix, "ng", natGateway.Name), d.randomNameSuffix),
+			PublicIpAddresses: network.SubResourceArray{
+				network.SubResourceArgs{
+					Id: pip.ID(),
+				},
+			},
+			ResourceGroupName: d.resourceGroup.Name,
+			Sku: &network.NatGatewaySkuArgs{
+				Name: pulumi.String("Standard"),
+			},
+			Tags: d.childTags(natGateway.Tags),
+		}
+		if natGateway.IdleTimeoutInMinutes != 0 {
+			natGatewayArgs.IdleTimeoutInMinutes = pulumi.Int(natGateway.IdleTimeoutInMinutes)
+		}
+
+		natGatewayResource, err := network.NewNatGateway(ctx, resourceName(nameSuffix, "ng", natGateway.Name), natGatewayArgs,
+			pulumi.DependsOn([]pulumi.Resource{pip}),
+			d.parentOf(d.resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.natGatewayMap[natGateway.Name] = natGatewayResource
+		d.addInventory("Microsoft.Network/natGateways", natGatewayResource)
+	}
+	exportIds(ctx, "natGateway", d.natGatewayMap)
+	return nil
+}
+
+// createSubnets creates the subnets, or reads existing ones, then peers the virtual network with remote ones. Subnets use
+// the 2024-05-01 API, the first to offer defaultOutboundAccess.
+func (d *deployment) createSubnets() error {
+	ctx, vnet, resourceGroup, virtualNetwork := d.ctx, d.plan.VNET, d.resourceGroup, d.virtualNetwork
+
+	// Create Subnets and associate with Network Security Groups and Route Tables.
+	d.snetMap = make(map[string]*networkv20240501.Subnet)
+	for _, snet := range vnet.SNET {
+		// Read an existing subnet by ID instead of creating one, for brownfield deployments. It is used as it is.
+		if snet.Existing {
+			snetResource, err := networkv20240501.GetSubnet(ctx, "snet-"+snet.Name, pulumi.ID(snet.Id), nil)
+			if err != nil {
+				return fmt.Errorf("failed to read existing subnet %q: %w", snet.Name, err)
+			}
+			d.snetMap[snet.Name] = snetResource
+			continue
+		}
+
+		snetDependencies := []pulumi.Resource{virtualNetwork}
+		snetArgs := &networkv20240501.SubnetArgs{
+			DefaultOutboundAccess:             pulumi.BoolPtrFromPtr(snet.DefaultOutboundAccess),
+			PrivateEndpointNetworkPolicies:    stringPtr(snet.PrivateEndpointNetworkPolicies),
+			PrivateLinkServiceNetworkPolicies: stringPtr(snet.PrivateLinkServiceNetworkPolicies),
+			ResourceGroupName:                 resourceGroup.Name,
+			VirtualNetworkName:                virtualNetwork.Name,
+		}
+
+		// Associate the subnet with its Network Security Group and Route Table, if configured.
+		if nsg, exists := d.nsgMap[snet.NSGName]; exists {
+			snetArgs.NetworkSecurityGroup = &networkv20240501.NetworkSecurityGroupTypeArgs{
+				Id: nsg.ID(),
+			}
+			snetDependencies = append(snetDependencies, nsg)
+		}
+		if rt, exists := d.rtMap[snet.RTName]; exists {
+			snetArgs.RouteTable = &networkv20240501.RouteTableTypeArgs{
+				Id: rt.ID(),
+			}
+			snetDependencies = append(snetDependencies, rt)
+		}
+
+		// Set the subnet's address prefix, or its list of prefixes for dual-stack subnets.
+		if len(snet.AddressPrefixes) > 0 {
+			snetArgs.AddressPrefixes = stringArray(snet.AddressPrefixes)
+		} else {
+			snetArgs.AddressPrefix = pulumi.String(snet.AddressPrefix)
+		}
+
+		// Route the subnet's outbound traffic through its NAT Gateway, if configured.
+		if natGateway, exists := d.natGatewayMap[snet.NatGatewayName]; exists {
+			snetArgs.NatGateway = &networkv20240501.SubResourceArgs{
+				Id: natGateway.ID(),
+			}
+			snetDependencies = append(snetDependencies, natGateway)
+		}
+
+		// Enable service endpoints, such as Microsoft.Storage, on the subnet.
+		if len(snet.ServiceEndpoints) > 0 {
+			var serviceEndpoints networkv20240501.ServiceEndpointPropertiesFormatArray
+			for _, service := range snet.ServiceEndpoints {
+				serviceEndpoints = append(serviceEndpoints, networkv20240501.ServiceEndpointPropertiesFormatArgs{
+					Service: pulumi.String(service),
+				})
+			}
+			snetArgs.ServiceEndpoints = serviceEndpoints
+		}
+
+		// Delegate the subnet to services, such as Microsoft.Web/serverFarms.
+		if len(snet.Delegations) > 0 {
+			var delegations networkv20240501.DelegationArray
+			for _, service := range snet.Delegations {
+				delegations = append(delegations, networkv20240501.DelegationArgs{
+					Name:        pulumi.String(strings.ReplaceAll(service, "/", "-")),
+					ServiceName: pulumi.String(service),
+				})
+			}
+			snetArgs.Delegations = delegations
+		}
+
+		snetResource, err := networkv20240501.NewSubnet(ctx, "snet-"+snet.Name, snetArgs,
+			pulumi.DependsOn(snetDependencies),
+			d.parentOf(virtualNetwork),
+		)
+		if err != nil {
+			return err
+		}
+		d.snetMap[snet.Name] = snetResource
+		d.addInventory("Microsoft.Network/virtualNetworks/subnets", snetResource)
+	}
+
+	// Peer the virtual network after its subnets, as Azure rejects concurrent changes to a virtual network.
+	peeringDependencies := []pulumi.Resource{virtualNetwork}
+	for _, snet := range vnet.SNET {
+		peeringDependencies = append(peeringDependencies, d.snetMap[snet.Name])
+	}
+	for _, peering := range vnet.Peerings {
+		peeringResource, err := network.NewVirtualNetworkPeering(ctx, "peer-"+peering.Name, &network.VirtualNetworkPeeringArgs{
+			AllowForwardedTraffic:     pulumi.Bool(peering.AllowForwardedTraffic),
+			AllowGatewayTransit:       pulumi.Bool(peering.AllowGatewayTransit),
+			AllowVirtualNetworkAccess: pulumi.Bool(true),
+			RemoteVirtualNetwork: &network.SubResourceArgs{
+				Id: pulumi.String(peering.RemoteVirtualNetworkId),
+			},
+			ResourceGroupName:         resourceGroup.Name,
+			UseRemoteGateways:         pulumi.Bool(peering.UseRemoteGateways),
+			VirtualNetworkName:        virtualNetwork.Name,
+			VirtualNetworkPeeringName: pulumi.String(peering.Name),
+		},
+			pulumi.DependsOn(peeringDependencies),
+			d.parentOf(virtualNetwork),
+		)
+		if err != nil {
+			return err
+		}
+		d.addInventory("Microsoft.Network/virtualNetworks/virtualNetworkPeerings", peeringResource)
+	}
+	exportIds(ctx, "subnet", d.snetMap)
+	return nil
+}
+
+// createLoadBalancer creates an internal Standard Load Balancer fronting the NICs, if configured. Its components refer to
+// each other by ID, built from an explicit Azure name.
+func (d *deployment) createLoadBalancer() error {
+	lb := d.plan.VNET.LoadBalancer
+	if lb.Name == "" {
+		return nil
+	}
+	lbLogicalName := resourceName(d.plan.NameSuffix, "lb", lb.Name)
+	lbName := explicitName(lbLogicalName, d.randomNameSuffix)
+	lbId := pulumi.Sprintf("%s/providers/Microsoft.Network/loadBalancers/%s", d.resourceGroup.ID(), lbName)
+	frontendId := pulumi.Sprintf("%s/frontendIPConfigurations/frontend", lbId)
+	backendPoolId := pulumi.Sprintf("%s/backendAddressPools/backend", lbId)
+	probeName := valueOrDefault(lb.Probe.Name, "probe")
+	probeId := pulumi.Sprintf("%s/probes/%s", lbId, probeName)
+
+	frontendArgs := network.FrontendIPConfigurationArgs{
+		Name:                      pulumi.String("frontend"),
+		PrivateIPAllocationMethod: pulumi.String("Dynamic"),
+		Subnet: &network.SubnetTypeArgs{
+			Id: d.snetMap[lb.FrontendSnetName].ID(),
+		},
+	}
+	if lb.FrontendPrivateIpAddress != "" {
+		frontendArgs.PrivateIPAddress = pulumi.String(lb.FrontendPrivateIpAddress)
+		frontendArgs.PrivateIPAllocationMethod = pulumi.String("Static")
+	}
+
+	var loadBalancingRules network.LoadBalancingRuleArray
+	for _, rule := range lb.Rules {
+		loadBalancingRules = append(loadBalancingRules, loadBalancingRuleArgs(rule, frontendId, backendPoolId, probeId))
+	}
+
+	loadBalancer, err := network.NewLoadBalancer(d.ctx, lbLogicalName, &network.LoadBalancerArgs{
+		BackendAddressPools: network.BackendAddressPoolArray{
+			network.BackendAddressPoolArgs{
+				Name: pulumi.String("backend"),
+			},
+		},
+		FrontendIPConfigurations: network.FrontendIPConfigurationArray{
+			frontendArgs,
+		},
+		LoadBalancerName:   lbName,
+		LoadBalancingRules: loadBalancingRules,
+		Location:           stringPtr(d.location),
+		Probes: network.ProbeArray{
+			loadBalancerProbeArgs(lb.Probe, probeName),
+		},
+		ResourceGroupName: d.resourceGroup.Name,
+		Sku: &network.LoadBalancerSkuArgs{
+			Name: pulumi.String("Standard"),
+			Tier: pulumi.String("Regional"),
+		},
+		Tags: d.childTags(lb.Tags),
+	},
+		pulumi.DependsOn([]pulumi.Resource{d.snetMap[lb.FrontendSnetName]}),
+		d.parentOf(d.resourceGroup),
+		pulumi.Timeouts(d.plan.Timeouts),
+	)
+	if err != nil {
+		return err
+	}
+	d.addInventory("Microsoft.Network/loadBalancers", loadBalancer)
+	pool := backendPool{loadBalancer: loadBalancer, id: backendPoolId, nics: make(map[string]bool)}
+	for _, nicName := range lb.BackendNics {
+		pool.nics[nicName] = true
+	}
+	d.backendPools = append(d.backendPools, pool)
+
+	// Export the load balancer's frontend private IP address.
+	d.ctx.Export("loadBalancerFrontendIpAddress", loadBalancer.FrontendIPConfigurations.Index(pulumi.Int(0)).PrivateIPAddress())
+	return nil
+}
+
+// createHaLoadBalancer creates a load balancer for an active/passive firewall pair, if configured. Its frontend is the
+// pair's floating IP, and every rule enables floating IP.
+func (d *deployment) createHaLoadBalancer() error {
+	haPair := d.plan.HaPair
+	if haPair.Name == "" {
+		return nil
+	}
+	haLogicalName := resourceName(d.plan.NameSuffix, "lb", haPair.Name)
+	haName := explicitName(haLogicalName, d.randomNameSuffix)
+	haId := pulumi.Sprintf("%s/providers/Microsoft.Network/loadBalancers/%s", d.resourceGroup.ID(), haName)
+	frontendId := pulumi.Sprintf("%s/frontendIPConfigurations/frontend", haId)
+	backendPoolId := pulumi.Sprintf("%s/backendAddressPools/backend", haId)
+	probeName := valueOrDefault(haPair.Probe.Name, "probe")
+	probeId := pulumi.Sprintf("%s/probes/%s", haId, probeName)
+
+	// Front the pair with a Public IP, or a private address in a subnet.
+	frontendArgs := network.FrontendIPConfigurationArgs{
+		Name: pulumi.String("frontend"),
+	}
+	var haDependencies []pulumi.Resource
+	if haPair.FrontendPipName != "" {
+		frontendArgs.PublicIPAddress = &network.PublicIPAddressTypeArgs{
+			Id: d.pipMap[haPair.FrontendPipName].ID(),
+		}
+		haDependencies = append(haDependencies, d.pipMap[haPair.FrontendPipName])
+	} else {
+		frontendArgs.PrivateIPAllocationMethod = pulumi.String("Dynamic")
+		frontendArgs.Subnet = &network.SubnetTypeArgs{
+			Id: d.snetMap[haPair.FrontendSnetName].ID(),
+		}
+		if haPair.FrontendPrivateIpAddress != "" {
+			frontendArgs.PrivateIPAddress = pulumi.String(haPair.FrontendPrivateIpAddress)
+			frontendArgs.PrivateIPAllocationMethod = pulumi.String("Static")
+		}
+		haDependencies = append(haDependencies, d.snetMap[haPair.FrontendSnetName])
+	}
+
+	var loadBalancingRules network.LoadBalancingRuleArray
+	for _, rule := range haPair.Rules {
+		rule.EnableFloatingIP = true
+		loadBalancingRules = append(loadBalancingRules, loadBalancingRuleArgs(rule, frontendId, backendPoolId, probeId))
+	}
+
+	haLoadBalancer, err := network.NewLoadBalancer(d.ctx, haLogicalName, &network.LoadBalancerArgs{
+		BackendAddressPools: network.BackendAddressPoolArray{
+			network.BackendAddressPoolArgs{
+				Name: pulumi.String("backend"),
+			},
+		},
+		FrontendIPConfigurations: network.FrontendIPConfigurationArray{
+			frontendArgs,
+		},
+		LoadBalancerName:   haName,
+		LoadBalancingRules: loadBalancingRules,
+		Location:           stringPtr(d.location),
+		Probes: network.ProbeArray{
+			loadBalancerProbeArgs(haPair.Probe, probeName),
+		},
+		ResourceGroupName: d.resourceGroup.Name,
+		Sku: &network.LoadBalancerSkuArgs{
+			Name: pulumi.String("Standard"),
+			Tier: pulumi.String("Regional"),
+		},
+		Tags: d.childTags(haPair.Tags),
+	},
+		pulumi.DependsOn(haDependencies),
+		d.parentOf(d.resourceGroup),
+		pulumi.Timeouts(d.plan.Timeouts),
+	)
+	if err != nil {
+		return err
+	}
+	d.addInventory("Microsoft.Network/loadBalancers", haLoadBalancer)
+	pool := backendPool{loadBalancer: haLoadBalancer, id: backendPoolId, nics: make(map[string]bool)}
+	for _, nicName := range haPairDataplaneNics(haPair, d.plan.VMs) {
+		pool.nics[nicName] = true
+	}
+	d.backendPools = append(d.backendPools, pool)
+	return nil
+}
+
+// createOutboundLoadBalancer creates a public load balancer with an outbound rule, if configured, giving its backend NICs
+// explicit SNAT through a dedicated Public IP. The internal load balancer can't hold outbound rules itself.
+func (d *deployment) createOutboundLoadBalancer() error {
+	outboundRule := d.plan.VNET.OutboundRule
+	if outboundRule.Name == "" {
+		return nil
+	}
+	outboundLogicalName := resourceName(d.plan.NameSuffix, "lb", outboundRule.Name)
+	outboundName := explicitName(outboundLogicalName, d.randomNameSuffix)
+	outboundId := pulumi.Sprintf("%s/providers/Microsoft.Network/loadBalancers/%s", d.resourceGroup.ID(), outboundName)
+	backendPoolId := pulumi.Sprintf("%s/backendAddressPools/backend", outboundId)
+
+	outboundRuleArgs := network.OutboundRuleArgs{
+		BackendAddressPool: network.SubResourceArgs{
+			Id: backendPoolId,
+		},
+		EnableTcpReset: pulumi.Bool(true),
+		FrontendIPConfigurations: network.SubResourceArray{
+			network.SubResourceArgs{
+				Id: pulumi.Sprintf("%s/frontendIPConfigurations/frontend", outboundId),
+			},
+		},
+		Name:     pulumi.String("outbound"),
+		Protocol: pulumi.String("All"),
+	}
+	if outboundRule.AllocatedOutboundPorts != 0 {
+		outboundRuleArgs.AllocatedOutboundPorts = pulumi.Int(outboundRule.AllocatedOutboundPorts)
+	}
+	if outboundRule.IdleTimeoutInMinutes != 0 {
+		outboundRuleArgs.IdleTimeoutInMinutes = pulumi.Int(outboundRule.IdleTimeoutInMinutes)
+	}
+
+	outboundLoadBalancer, err := network.NewLoadBalancer(d.ctx, outboundLogicalName, &network.LoadBalancerArgs{
+		BackendAddressPools: network.BackendAddressPoolArray{
+			network.BackendAddressPoolArgs{
+				Name: pulumi.String("backend"),
+			},
+		},
+		FrontendIPConfigurations: network.FrontendIPConfigurationArray{
+			network.FrontendIPConfigurationArgs{
+				Name: pulumi.String("frontend"),
+				PublicIPAddress: &network.PublicIPAddressTypeArgs{
+					Id: d.pipMap[outboundRule.PipName].ID(),
+				},
+			},
+		},
+		LoadBalancerName:  outboundName,
+		Location:          stringPtr(d.location),
+		OutboundRules:     network.OutboundRuleArray{outboundRuleArgs},
+		ResourceGroupName: d.resourceGroup.Name,
+		Sku: &network.LoadBalancerSkuArgs{
+			Name: pulumi.String("Standard"),
+			Tier: pulumi.String("Regional"),
+		},
+		Tags: d.childTags(outboundRule.Tags),
+	},
+		pulumi.DependsOn([]pulumi.Resource{d.pipMap[outboundRule.PipName]}),
+		d.parentOf(d.resourceGroup),
+		pulumi.Timeouts(d.plan.Timeouts),
+	)
+	if err != nil {
+		return err
+	}
+	d.addInventory("Microsoft.Network/loadBalancers", outboundLoadBalancer)
+	pool := backendPool{loadBalancer: outboundLoadBalancer, id: backendPoolId, nics: make(map[string]bool)}
+	for _, nicName := range outboundRule.BackendNics {
+		pool.nics[nicName] = true
+	}
+	d.backendPools = append(d.backendPools, pool)
+	return nil
+}
+
+// createNetworkInterfaces creates the NICs, or reads existing ones. Each NIC only depends on the subnets, Public IPs and
+// load balancers it references.
+func (d *deployment) createNetworkInterfaces() error {
+	ctx, nameSuffix := d.ctx, d.plan.NameSuffix
+
+	// Create NICs.
+	d.nicMap = make(map[string]*network.NetworkInterface)
+	for _, nic := range d.plan.VNET.NIC {
+		// Read an existing NIC by ID instead of creating one, for brownfield deployments.
+		if nic.Existing {
+			nicResource, err := network.GetNetworkInterface(ctx, resourceName(nameSuffix, "nic", nic.Name), pulumi.ID(nic.Id), nil)
+			if err != nil {
+				return fmt.Errorf("failed to read existing nic %q: %w", nic.Name, err)
+			}
+			d.nicMap[nic.Name] = nicResource
+			continue
+		}
+
+		nicDependencies := []pulumi.Resource{}
+		var ipConfigurations network.NetworkInterfaceIPConfigurationArray
+		for _, ipConfig := range nic.IpConfigurations {
+			ipConfigArgs, ipConfigDependencies := d.ipConfigurationArgs(nic, ipConfig)
+			ipConfigurations = append(ipConfigurations, ipConfigArgs)
+			nicDependencies = append(nicDependencies, ipConfigDependencies...)
+		}
+
+		nicArgs := &network.NetworkInterfaceArgs{
+			AuxiliaryMode:               stringPtr(nic.AuxiliaryMode),
+			AuxiliarySku:                stringPtr(nic.AuxiliarySku),
+			EnableAcceleratedNetworking: pulumi.Bool(nic.EnableAcceleratedNetworking),
+			EnableIPForwarding:          pulumi.Bool(nic.EnableIPForwarding),
+			NicType:                     pulumi.String(valueOrDefault(nic.NicType, "Standard")),
+			IpConfigurations:            ipConfigurations,
+			Location:                    stringPtr(d.location),
+			NetworkInterfaceName:        randomizedName(resourceName(nameSuffix, "nic", nic.Name), d.randomNameSuffix),
+			ResourceGroupName:           d.resourceGroup.Name,
+			Tags:                        d.childTags(nic.Tags),
+		}
+
+		// Disable TCP state tracking, if configured.
+		if nic.DisableTcpStateTracking {
+			nicArgs.DisableTcpStateTracking = pulumi.Bool(true)
+		}
+
+		// Point the NIC at custom DNS servers, if configured.
+		if len(nic.DnsServers) > 0 {
+			nicArgs.DnsSettings = &network.NetworkInterfaceDnsSettingsArgs{
+				DnsServers: pulumi.ToStringArray(nic.DnsServers),
+			}
+		}
+
+		nicResource, err := network.NewNetworkInterface(ctx, resourceName(nameSuffix, "nic", nic.Name), nicArgs,
+			pulumi.DependsOn(nicDependencies),
+			d.parentOf(d.resourceGroup),
+		)
+		if err != nil {
+			return err
+		}
+		d.nicMap[nic.Name] = nicResource
+		d.addInventory("Microsoft.Network/networkInterfaces", nicResource)
+	}
+	exportIds(ctx, "nic", d.nicMap)
+	return nil
+}
+
+// ipConfigurationArgs returns a NIC's IP configuration, and the resources it references.
+func (d *deployment) ipConfigurationArgs(nic NIC, ipConfig IpConfig) (network.NetworkInterfaceIPConfigurationArgs, []pulumi.Resource) {
+	ipConfigArgs := network.NetworkInterfaceIPConfigurationArgs{
+		Name:                    pulumi.String(ipConfig.Name),
+		Primary:                 pulumi.Bool(ipConfig.Primary),
+		PrivateIPAddressVersion: stringPtr(ipConfig.Version),
+		Subnet: &network.SubnetTypeArgs{
+			Id: d.snetMap[ipConfig.SnetName].ID(),
+		},
+	}
+	dependencies := []pulumi.Resource{d.snetMap[ipConfig.SnetName]}
+
+	// Assign the IP configuration a static private IP address, if configured.
+	if ipConfig.PrivateIpAddress != "" {
+		ipConfigArgs.PrivateIPAddress = pulumi.String(ipConfig.PrivateIpAddress)
+		ipConfigArgs.PrivateIPAllocationMethod = pulumi.String("Static")
+	}
+
+	// Associate the IP configuration with the NIC's Application Security Groups.
+	if len(nic.ApplicationSecurityGroups) > 0 {
+		var applicationSecurityGroups network.ApplicationSecurityGroupTypeArray
+		for _, asgName := range nic.ApplicationSecurityGroups {
+			applicationSecurityGroups = append(applicationSecurityGroups, network.ApplicationSecurityGroupTypeArgs{
+				Id: d.asgMap[asgName].ID(),
+			})
+		}
+		ipConfigArgs.ApplicationSecurityGroups = applicationSecurityGroups
+	}
+
+	// Add the NIC's primary IP configuration to the backend pools it is a member of.
+	var backendAddressPools network.BackendAddressPoolArray
+	for _, pool := range d.backendPools {
+		if ipConfig.Primary && pool.nics[nic.Name] {
+			backendAddressPools = append(backendAddressPools, network.BackendAddressPoolArgs{
+				Id: pool.id,
+			})
+			dependencies = append(dependencies, pool.loadBalancer)
+		}
+	}
+	if len(backendAddressPools) > 0 {
+		ipConfigArgs.LoadBalancerBackendAddressPools = backendAddressPools
+	}
+
+	// Chain the IP configuration to a Gateway Load Balancer frontend, which redirects its traffic for inspection.
+	if ipConfig.GatewayLoadBalancerFrontendId != "" {
+		ipConfigArgs.GatewayLoadBalancer = &network.SubResourceArgs{
+			Id: pulumi.String(ipConfig.GatewayLoadBalancerFrontendId),
+		}
+	}
+
+	// Check if pipMap contains the ipConfig.PipName
+	if pip, exists := d.pipMap[ipConfig.PipName]; exists {
+		ipConfigArgs.PublicIPAddress = &network.PublicIPAddressTypeArgs{
+			Id: pip.ID(),
+		}
+		dependencies = append(dependencies, pip)
+	}
+	return ipConfigArgs, dependencies
+}
+
+// createApplicationGateway creates an HTTPS Application Gateway in front of a NIC, typically the firewall's management
+// NIC, if configured. Its certificate is read from Key Vault through a user-assigned identity.
+func (d *deployment) createApplicationGateway() error {
+	agw := d.plan.VNET.ApplicationGateway
+	if agw.Name == "" {
+		return nil
+	}
+	agwLogicalName := resourceName(d.plan.NameSuffix, "agw", agw.Name)
+	agwName := explicitName(agwLogicalName, d.randomNameSuffix)
+	agwId := pulumi.Sprintf("%s/providers/Microsoft.Network/applicationGateways/%s", d.resourceGroup.ID(), agwName)
+	skuName := valueOrDefault(agw.SkuName, "Standard_v2")
+	capacity := agw.Capacity
+	if capacity == 0 {
+		capacity = 2
+	}
+	frontendPort := agw.FrontendPort
+	if frontendPort == 0 {
+		frontendPort = 443
+	}
+	backendPort := agw.BackendPort
+	if backendPort == 0 {
+		backendPort = 443
+	}
+
+	backendHttpSettings := network.ApplicationGatewayBackendHttpSettingsArgs{
+		CookieBasedAffinity: pulumi.String("Disabled"),
+		Name:                pulumi.String("settings"),
+		Port:                pulumi.Int(backendPort),
+		Protocol:            pulumi.String(valueOrDefault(agw.BackendProtocol, "Https")),
+		RequestTimeout:      pulumi.Int(30),
+	}
+
+	agwArgs := &network.ApplicationGatewayArgs{
+		ApplicationGatewayName: agwName,
+		BackendAddressPools: network.ApplicationGatewayBackendAddressPoolArray{
+			network.ApplicationGatewayBackendAddressPoolArgs{
+				BackendAddresses: network.ApplicationGatewayBackendAddressArray{
+					network.ApplicationGatewayBackendAddressArgs{
+						IpAddress: d.nicMap[agw.BackendNicName].IpConfigurations.Index(pulumi.Int(0)).PrivateIPAddress(),
+					},
+				},
+				Name: pulumi.String("backend"),
+			},
+		},
+		FrontendIPConfigurations: network.ApplicationGatewayFrontendIPConfigurationArray{
+			network.ApplicationGatewayFrontendIPConfigurationArgs{
+				Name: pulumi.String("frontend"),
+				PublicIPAddress: &network.SubResourceArgs{
+					Id: d.pipMap[agw.FrontendPipName].ID(),
+				},
+			},
+		},
+		FrontendPorts: network.ApplicationGatewayFrontendPortArray{
+			network.ApplicationGatewayFrontendPortArgs{
+				Name: pulumi.String("frontend"),
+				Port: pulumi.Int(frontendPort),
+			},
+		},
+		GatewayIPConfigurations: network.ApplicationGatewayIPConfigurationArray{
+			network.ApplicationGatewayIPConfigurationArgs{
+				Name: pulumi.String("gateway"),
+				Subnet: &network.SubResourceArgs{
+					Id: d.snetMap[agw.SnetName].ID(),
+				},
+			},
+		},
+		HttpListeners: network.ApplicationGatewayHttpListenerArray{
+			network.ApplicationGatewayHttpListenerArgs{
+				FrontendIPConfiguration: &network.SubResourceArgs{
+					Id: pulumi.Sprintf("%s/frontendIPConfigurations/frontend", agwId),
+				},
+				FrontendPort: &network.SubResourceArgs{
+					Id: pulumi.Sprintf("%s/frontendPorts/frontend", agwId),
+				},
+				Name:     pulumi.String("listener"),
+				Protocol: pulumi.String("Https"),
+				SslCertificate: &network.SubResourceArgs{
+					Id: pulumi.Sprintf("%s/sslCertificates/certificate", agwId),
+				},
+			},
+		},
+		Identity: &network.ManagedServiceIdentityArgs{
+			Type:                   network.ResourceIdentityTypeUserAssigned,
+			UserAssignedIdentities: pulumi.StringArray{pulumi.String(agw.IdentityId)},
+		},
+		Location: stringPtr(d.location),
+		RequestRoutingRules: network.ApplicationGatewayRequestRoutingRuleArray{
+			network.ApplicationGatewayRequestRoutingRuleArgs{
+				BackendAddressPool: &network.SubResourceArgs{
+					Id: pulumi.Sprintf("%s/backendAddressPools/backend", agwId),
+				},
+				BackendHttpSettings: &network.SubResourceArgs{
+					Id: pulumi.Sprintf("%s/backendHttpSettingsCollection/settings", agwId),
+				},
+				HttpListener: &network.SubResourceArgs{
+					Id: pulumi.Sprintf("%s/httpListeners/listener", agwId),
+				},
+				Name:     pulumi.String("rule"),
+				Priority: pulumi.Int(100),
+				RuleType: pulumi.String("Basic"),
+			},
+		},
+		ResourceGroupName: d.resourceGroup.Name,
+		Sku: &network.ApplicationGatewaySkuArgs{
+			Capacity: pulumi.Int(capacity),
+			Name:     pulumi.String(skuName),
+			Tier:     pulumi.String(skuName),
+		},
+		SslCertificates: network.ApplicationGatewaySslCertificateArray{
+			network.ApplicationGatewaySslCertificateArgs{
+				KeyVaultSecretId: pulumi.String(agw.CertificateSecretId),
+				Name:             pulumi.String("certificate"),
+			},
+		},
+		Tags: d.childTags(agw.Tags),
+	}
+
+	// Trust the backend's certificate through a root certificate from Key Vault, if configured.
+	if agw.TrustedRootCertificateSecretId != "" {
+		agwArgs.TrustedRootCertificates = network.ApplicationGatewayTrustedRootCertificateArray{
+			network.ApplicationGatewayTrustedRootCertificateArgs{
+				KeyVaultSecretId: pulumi.String(agw.TrustedRootCertificateSecretId),
+				Name:             pulumi.String("backend"),
+			},
+		}
+		backendHttpSettings.TrustedRootCertificates = network.SubResourceArray{
+			network.SubResourceArgs{
+				Id: pulumi.Sprintf("%s/trustedRootCertificates/backend", agwId),
+			},
+		}
+	}
+	agwArgs.BackendHttpSettingsCollection = network.ApplicationGatewayBackendHttpSettingsArray{backendHttpSettings}
+
+	// Enable the WAF in prevention mode for the WAF_v2 SKU.
+	if skuName == "WAF_v2" {
+		agwArgs.WebApplicationFirewallConfiguration = &network.ApplicationGatewayWebApplicationFirewallConfigurationArgs{
+			Enabled:        pulumi.Bool(true),
+			FirewallMode:   pulumi.String("Prevention"),
+			RuleSetType:    pulumi.String("OWASP"),
+			RuleSetVersion: pulumi.String("3.2"),
+		}
+	}
+
+	applicationGateway, err := network.NewApplicationGateway(d.ctx, agwLogicalName, agwArgs,
+		pulumi.DependsOn([]pulumi.Resource{d.snetMap[agw.SnetName], d.pipMap[agw.FrontendPipName], d.nicMap[agw.BackendNicName]}),
+		d.parentOf(d.resourceGroup),
+		pulumi.Timeouts(d.plan.Timeouts),
+	)
+	if err != nil {
+		return err
+	}
+	d.addInventory("Microsoft.Network/applicationGateways", applicationGateway)
+
+	// Export the Application Gateway's public IP address.
+	d.ctx.Export("applicationGatewayPublicIpAddress", d.pipMap[agw.FrontendPipName].IpAddress)
+	return nil
+}
+
+// createBastionHost creates a Bastion host in the AzureBastionSubnet, if configured, giving browser-based SSH and RDP
+// access to the VMs without exposing them on their own Public IPs.
+func (d *deployment) createBastionHost() error {
+	bastion := d.plan.VNET.Bastion
+	if bastion.Name == "" {
+		return nil
+	}
+	bastionLogicalName := resourceName(d.plan.NameSuffix, "bas", bastion.Name)
+	bastionHost, err := network.NewBastionHost(d.ctx, bastionLogicalName, &network.BastionHostArgs{
+		BastionHostName: randomizedName(bastionLogicalName, d.randomNameSuffix),
+		IpConfigurations: network.BastionHostIPConfigurationArray{
+			network.BastionHostIPConfigurationArgs{
+				Name: pulumi.String("ipconfig"),
+				PublicIPAddress: network.SubResourceArgs{
+					Id: d.pipMap[bastion.PipName].ID(),
+				},
+				Subnet: network.SubResourceArgs{
+					Id: d.snetMap[bastionSubnetName].ID(),
+				},
+			},
+		},
+		Location:          stringPtr(d.location),
+		ResourceGroupName: d.resourceGroup.Name,
+		Sku: &network.SkuArgs{
+			Name: pulumi.String(valueOrDefault(bastion.SkuName, "Basic")),
+		},
+		Tags: d.childTags(bastion.Tags),
+	},
+		pulumi.DependsOn([]pulumi.Resource{d.snetMap[bastionSubnetName], d.pipMap[bastion.PipName]}),
+		d.parentOf(d.resourceGroup),
+		pulumi.Timeouts(d.plan.Timeouts),
+	)
+	if err != nil {
+		return err
+	}
+	d.addInventory("Microsoft.Network/bastionHosts", bastionHost)
+
+	// Export the Bastion host's FQDN.
+	d.ctx.Export("bastionFqdn", bastionHost.DnsName)
+	return nil
+}
+
+// createBootstrapStorage creates a storage account and file share for PAN-OS bootstrapping, if configured, and returns
+// the custom data pointing PAN-OS at the share.
+func (d *deployment) createBootstrapStorage() (pulumi.StringPtrInput, error) {
+	ctx, nameSuffix, resourceGroup := d.ctx, d.plan.NameSuffix, d.resourceGroup
+	bootstrap := d.plan.Bootstrap
+	if bootstrap.StorageAccountName == "" {
+		return nil, nil
+	}
+
+	storageAccountArgs := &storage.StorageAccountArgs{
+		AccountName:           pulumi.String(bootstrap.StorageAccountName),
+		AllowBlobPublicAccess: pulumi.Bool(false),
+		Kind:                  pulumi.String("StorageV2"),
+		Location:              stringPtr(d.location),
+		MinimumTlsVersion:     pulumi.String("TLS1_2"),
+		ResourceGroupName:     resourceGroup.Name,
+		Sku: storage.SkuArgs{
+			Name: pulumi.String("Standard_LRS"),
+		},
+		Tags: d.childTags(nil),
+	}
+	storageAccountDependencies := []pulumi.Resource{resourceGroup}
+	if bootstrap.SnetName != "" {
+		storageAccountArgs.NetworkRuleSet = &storage.NetworkRuleSetArgs{
+			Bypass:        pulumi.String("AzureServices"),
+			DefaultAction: storage.DefaultActionDeny,
+			VirtualNetworkRules: storage.VirtualNetworkRuleArray{
+				storage.VirtualNetworkRuleArgs{
+					VirtualNetworkResourceId: d.snetMap[bootstrap.SnetName].ID(),
+				},
+			},
+		}
+		storageAccountDependencies = append(storageAccountDependencies, d.snetMap[bootstrap.SnetName])
+	}
+	storageAccount, err := storage.NewStorageAccount(ctx, resourceName(nameSuffix, "st", "bootstrap"), storageAccountArgs,
+		pulumi.DependsOn(storageAccountDependencies),
+		d.parentOf(resourceGroup),
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.addInventory("Microsoft.Storage/storageAccounts", storageAccount)
+	bootstrapShare, err := storage.NewFileShare(ctx, resourceName(nameSuffix, "share", "bootstrap"), &storage.FileShareArgs{
+		AccountName:       storageAccount.Name,
+		ResourceGroupName: resourceGroup.Name,
+		ShareName:         pulumi.String(bootstrap.FileShare),
+	},
+		pulumi.DependsOn([]pulumi.Resource{storageAccount}),
+		d.parentOf(storageAccount),
+	)
+	if err != nil {
+		return nil, err
+	}
+	d.addInventory("Microsoft.Storage/storageAccounts/fileServices/shares", bootstrapShare)
+
+	// Read the storage account's access key, and build the bootstrap custom data from it.
+	accessKey := storage.ListStorageAccountKeysOutput(ctx, storage.ListStorageAccountKeysOutputArgs{
+		AccountName:       storageAccount.Name,
+		ResourceGroupName: resourceGroup.Name,
+	}).Keys().Index(pulumi.Int(0)).Value()
+	bootstrapCustomData := pulumi.ToSecret(accessKey.ApplyT(func(key string) string {
+		return base64.StdEncoding.EncodeToString([]byte(bootstrapUserData(bootstrap, key)))
+	})).(pulumi.StringOutput)
+
+	// Export the bootstrap share's connection details as a secret.
+	ctx.Export("bootstrapShare", pulumi.ToSecret(pulumi.Map{
+		"accessKey":      accessKey,
+		"fileShare":      pulumi.String(bootstrap.FileShare),
+		"shareDirectory": pulumi.String(bootstrap.ShareDirectory),
+		"storageAccount": storageAccount.Name,
+	}))
+	return bootstrapCustomData, nil
+}
+
+// acceptMarketplaceTerms accepts the marketplace terms for each plan once, if acceptMarketplaceTerms is set, returning
+// the agreements by marketplaceAgreementKey for the VMs to depend on.
+func (d *deployment) acceptMarketplaceTerms() (map[string]pulumi.Resource, error) {
+	marketplaceAgreements := map[string]pulumi.Resource{}
+	for _, agreementPlan := range d.plan.MarketplaceAgreements {
+		agreementKey := marketplaceAgreementKey(agreementPlan)
+		agreement, err := marketplaceordering.NewMarketplaceAgreement(d.ctx, resourceName(d.plan.NameSuffix, "terms", agreementKey), &marketplaceordering.MarketplaceAgreementArgs{
+			OfferId:   pulumi.String(agreementPlan.Product),
+			OfferType: pulumi.String("virtualmachine"),
+			PlanId:    pulumi.String(agreementPlan.Name),
+			Properties: marketplaceordering.AgreementTermsPropertiesArgs{
+				Accepted: pulumi.Bool(true),
+			},
+			PublisherId: pulumi.String(agreementPlan.Publisher),
+		},
+			d.parentOf(d.resourceGroup),
+			pulumi.Protect(d.plan.ProtectResources),
+		)
+		if err != nil {
+			return nil, err
+		}
+		d.addInventory("Microsoft.MarketplaceOrdering/offerTypes/publishers/offers/plans/agreements", agreement)
+		marketplaceAgreements[agreementKey] = agreement
+	}
+	return marketplaceAgreements, nil
+}
+
+// createVirtualMachines creates the VMs and exports their private IP addresses, identity principal IDs, image versions and
+// agent readiness, keyed by VM.
+func (d *deployment) createVirtualMachines(bootstrapCustomData pulumi.StringPtrInput, marketplaceAgreements map[string]pulumi.Resource) error {
+	ctx := d.ctx
+	privateIpAddresses := pulumi.StringMap{}
+	principalIds := pulumi.StringMap{}
+	imageVersions := pulumi.StringMap{}
+	vmReady := pulumi.BoolMap{}
+	availabilitySetMap := make(map[string]*compute.AvailabilitySet)
+	for _, vm := range d.plan.VMs {
+		virtualMachine, err := d.createVirtualMachine(vm, bootstrapCustomData, marketplaceAgreements, availabilitySetMap)
+		if err != nil {
+			return err
+		}
+
+		// Collect the primary NIC's private IP address. This resolves once the NIC has been created.
+		privateIpAddresses[vmKey(vm)] = d.nicMap[nicMapNames(vm.NicMap)[0]].IpConfigurations.Index(pulumi.Int(0)).PrivateIPAddress().Elem()
+
+		// Collect the principal ID of the VM's system-assigned identity, if enabled.
+		if strings.HasPrefix(vm.Identity.Type, "SystemAssigned") {
+			principalIds[vmKey(vm)] = virtualMachine.Identity.PrincipalId().Elem()
+		}
+
+		// Collect the concrete image version the VM was deployed from, which Azure resolves "latest" to.
+		imageVersions[vmKey(vm)] = virtualMachine.StorageProfile.ImageReference().ExactVersion().Elem()
+
+		// Wait for the VM agent to report ready, if enabled, for at most agentReadyTimeout. Previews leave vmReady unknown.
+		if vm.WaitForAgentReady && ctx.DryRun() {
+			vmReady[vmKey(vm)] = pulumi.UnsafeUnknownOutput([]pulumi.Resource{virtualMachine}).(pulumi.AnyOutput).AsBoolOutput()
+		} else if vm.WaitForAgentReady {
+			vmReady[vmKey(vm)] = pulumi.All(d.resourceGroup.Name, virtualMachine.Name).ApplyT(func(args []interface{}) (bool, error) {
+				return waitForAgentReady(ctx, args[0].(string), args[1].(string))
+			}).(pulumi.BoolOutput)
+		}
+
+		// Collect the VM's ID and size for the summary.
+		d.vmSummaries[vmKey(vm)] = pulumi.Map{
+			"id":   virtualMachine.ID(),
+			"size": pulumi.String(vm.VmSize),
+		}
+	}
+
+	// Export the VMs' private IP addresses, identity principal IDs, image versions and agent readiness.
+	ctx.Export("privateIpAddresses", privateIpAddresses)
+	ctx.Export("principalIds", principalIds)
+	ctx.Export("imageVersions", imageVersions)
+	ctx.Export("vmReady", vmReady)
+	return nil
+}
+
+// createVirtualMachine creates a VM with its OS disk ID, availability set and extensions, after its NICs and the
+// marketplace agreement for its plan.
+func (d *deployment) createVirtualMachine(vm VM, bootstrapCustomData pulumi.StringPtrInput, marketplaceAgreements map[string]pulumi.Resource, availabilitySetMap map[string]*compute.AvailabilitySet) (*compute.VirtualMachine, error) {
+	ctx, plan, nameSuffix := d.ctx, d.plan, d.plan.NameSuffix
+
+	// Define the VM's NIC references, skipping blank entries in its NIC map.
+	networkInterfaces, err := buildNetworkInterfaceReferences(vm.NicMap, d.nicMap)
+	if err != nil {
+		return nil, fmt.Errorf("vm %q: %w", vmKey(vm), err)
+	}
+
+	// Create a random ID for the OS disk. Its inputs must never change, or the VM is replaced along with it.
+	randomOsDiskIdName := "random-os-disk-id"
+	if vm.Name != "" {
+		randomOsDiskIdName += "-" + vm.Name
+	}
+	randomOsDiskId, err := random.NewRandomString(ctx, randomOsDiskIdName, &random.RandomStringArgs{
+		Length:     pulumi.Int(plan.OsDiskIdLength),
+		Lower:      pulumi.Bool(true),
+		MinLower:   pulumi.Int(plan.OsDiskIdLength / 2),
+		MinNumeric: pulumi.Int(plan.OsDiskIdLength / 2),
+		Numeric:    pulumi.Bool(true),
+		Special:    pulumi.Bool(false),
+		Upper:      pulumi.Bool(plan.OsDiskIdUpper),
+	},
+		pulumi.Protect(plan.ProtectResources),
+	)
+	if err != nil {
+		return nil, err
+	}
+	vmDependencies := []pulumi.Resource{randomOsDiskId}
+	for _, nicName := range nicMapNames(vm.NicMap) {
+		vmDependencies = append(vmDependencies, d.nicMap[nicName])
+	}
+
+	// Wait for the marketplace terms of the VM's plan to be accepted.
+	if vmPlan, required := imagePlan(vm.Image); required {
+		if agreement, ok := marketplaceAgreements[marketplaceAgreementKey(vmPlan)]; ok {
+			vmDependencies = append(vmDependencies, agreement)
+		}
+	}
+
+	osProfile, err := vmOsProfile(ctx, vm, bootstrapCustomData)
+	if err != nil {
+		return nil, err
+	}
+	dataDisks, err := vmDataDisks(vm, vmDiskNameSuffix(vm, nameSuffix), randomOsDiskId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Define the VM's user data, which unlike custom data can be read again from the instance metadata service.
+	var userData pulumi.StringPtrInput
+	if vm.UserData != "" {
+		userData = pulumi.String(base64.StdEncoding.EncodeToString([]byte(vm.UserData)))
+	}
+
+	// Define the VM's boot diagnostics. Managed storage is used unless a storage account URI is supplied.
+	var diagnosticsProfile compute.DiagnosticsProfilePtrInput
+	if vm.BootDiagnostics || vm.BootDiagnosticsStorageUri != "" {
+		bootDiagnostics := compute.BootDiagnosticsArgs{
+			Enabled: pulumi.Bool(true),
+		}
+		if vm.BootDiagnosticsStorageUri != "" {
+			bootDiagnostics.StorageUri = pulumi.String(vm.BootDiagnosticsStorageUri)
+		}
+		diagnosticsProfile = compute.DiagnosticsProfileArgs{
+			BootDiagnostics: bootDiagnostics,
+		}
+	}
+
+	// Define the VM's managed identity. The identity block is omitted when no type is configured.
+	var identity compute.VirtualMachineIdentityPtrInput
+	if vm.Identity.Type != "" {
+		identity = compute.VirtualMachineIdentityArgs{
+			Type:                   compute.ResourceIdentityType(vm.Identity.Type),
+			UserAssignedIdentities: stringArray(vm.Identity.UserAssignedIdentities),
+		}
+	}
+
+	// Define the VM's spot pricing. A max price of -1, Azure's default, caps the price at the pay-as-you-go rate.
+	var billingProfile compute.BillingProfilePtrInput
+	if vm.MaxPrice != 0 {
+		billingProfile = compute.BillingProfileArgs{
+			MaxPrice: pulumi.Float64(vm.MaxPrice),
+		}
+	}
+
+	// Define the VM's availability zone, if pinned.
+	var vmZones []string
+	if vm.Zone != "" {
+		vmZones = []string{vm.Zone}
+	}
+
+	availabilitySet, availabilitySetDependency, err := d.vmAvailabilitySet(vm, availabilitySetMap)
+	if err != nil {
+		return nil, err
+	}
+	if availabilitySetDependency != nil {
+		vmDependencies = append(vmDependencies, availabilitySetDependency)
+	}
+
+	// Define the VM's proximity placement group, if configured.
+	var proximityPlacementGroup compute.SubResourcePtrInput
+	if vm.ProximityPlacementGroupId != "" {
+		proximityPlacementGroup = compute.SubResourceArgs{
+			Id: pulumi.String(vm.ProximityPlacementGroupId),
+		}
+	}
+
+	imageReference, purchasePlan, ignoredVmChanges, err := d.vmImage(vm)
+	if err != nil {
+		return nil, err
+	}
+	osDisk, err := vmOsDisk(ctx, vm, nameSuffix, randomOsDiskId)
+	if err != nil {
+		return nil, err
+	}
+
+	// An attached OS disk keeps its own OS configuration, so the VM has no OS profile.
+	var vmOsProfileArgs compute.OSProfilePtrInput = osProfile
+	if vm.OsDiskCreateOption == "Attach" {
+		vmOsProfileArgs = nil
+	}
+
+	// Create a virtual machine. Unnamed VMs keep the original solution-based name.
+	virtualMachineName := "vm-" + plan.Tags.Solution + "-prod-"
+	if vm.Name != "" {
+		virtualMachineName = resourceName(nameSuffix, "vm", vm.Name)
+	}
+	virtualMachine, err := compute.NewVirtualMachine(ctx, virtualMachineName, &compute.VirtualMachineArgs{
+		AdditionalCapabilities: vmAdditionalCapabilities(vm),
+		AvailabilitySet:        availabilitySet,
+		BillingProfile:         billingProfile,
+		DiagnosticsProfile:     diagnosticsProfile,
+		EvictionPolicy:         stringPtr(vm.EvictionPolicy),
+		HardwareProfile: compute.HardwareProfileArgs{
+			VmSize: pulumi.String(vm.VmSize),
+		},
+		Identity: identity,
+		Location: stringPtr(d.location),
+		NetworkProfile: compute.NetworkProfileArgs{
+			NetworkInterfaces: networkInterfaces,
+		},
+		OsProfile:               vmOsProfileArgs,
+		Plan:                    purchasePlan,
+		Priority:                stringPtr(vm.Priority),
+		ProximityPlacementGroup: proximityPlacementGroup,
+		ResourceGroupName:       d.resourceGroup.Name,
+		SecurityProfile:         vmSecurityProfile(vm),
+		StorageProfile: compute.StorageProfileArgs{
+			DataDisks:      dataDisks,
+			ImageReference: imageReference,
+			OsDisk:         osDisk,
+		},
+		Tags:     d.childTags(vm.Tags),
+		UserData: userData,
+		VmName:   randomizedName(virtualMachineName, d.randomNameSuffix),
+		Zones:    stringArray(vmZones),
+	},
+		pulumi.DependsOn(vmDependencies),
+		d.parentOf(d.resourceGroup),
+		pulumi.IgnoreChanges(ignoredVmChanges),
+		pulumi.Protect(plan.ProtectResources),
+		pulumi.Timeouts(plan.Timeouts),
+	)
+	ctx.Value(virtualMachine)
+	if err != nil {
+		return nil, err
+	}
+	d.addInventory("Microsoft.Compute/virtualMachines", virtualMachine)
+
+	// Create the VM's extensions.
+	for _, extension := range vm.Extensions {
+		extensionArgs := &compute.VirtualMachineExtensionArgs{
+			Location:           stringPtr(d.location),
+			Publisher:          pulumi.String(extension.Publisher),
+			ResourceGroupName:  d.resourceGroup.Name,
+			Tags:               d.childTags(vm.Tags),
+			Type:               pulumi.String(extension.Type),
+			TypeHandlerVersion: pulumi.String(extension.TypeHandlerVersion),
+			VmExtensionName:    pulumi.String(extension.Name),
+			VmName:             virtualMachine.Name,
+		}
+		if len(extension.Settings) > 0 {
+			extensionArgs.Settings = pulumi.Any(extension.Settings)
+		}
+		extensionResource, err := compute.NewVirtualMachineExtension(ctx, resourceName(nameSuffix, "ext", vmKey(vm)+"-"+extension.Name), extensionArgs,
+			pulumi.DependsOn([]pulumi.Resource{virtualMachine}),
+			d.parentOf(virtualMachine),
+			pulumi.Timeouts(plan.Timeouts),
+		)
+		if err != nil {
+			return nil, err
+		}
+		d.addInventory("Microsoft.Compute/virtualMachines/extensions", extensionResource)
+	}
+	return virtualMachine, nil
+}
+
+// vmOsProfile returns a VM's OS profile, with its Windows or Linux configuration and custom data. The admin password is
+// only passed through when password authentication is in use, and bootstrap custom data replaces the VM's own.
+func vmOsProfile(ctx *pulumi.Context, vm VM, bootstrapCustomData pulumi.StringPtrInput) (compute.OSProfileArgs, error) {
+	osProfile := compute.OSProfileArgs{
+		AdminUsername:            pulumi.String(vm.AdminUsername),
+		AllowExtensionOperations: pulumi.Bool(true),
+		ComputerName:             pulumi.String(vm.ComputerName),
+	}
+	if len(vm.SshPublicKeys) == 0 {
+		osProfile.AdminPassword = pulumi.String(vm.AdminPassword)
+		if vm.AdminPasswordSecretId != "" {
+			adminPassword, err := readKeyVaultSecret(ctx, vm.AdminPasswordSecretId)
+			if err != nil {
+				return osProfile, fmt.Errorf("vm %q adminPasswordSecretId: %w", vmKey(vm), err)
+			}
+			osProfile.AdminPassword = adminPassword
+		}
+	}
+
+	if vm.OsType == "Windows" {
+		// Define the Windows configuration.
+		windowsConfiguration := compute.WindowsConfigurationArgs{
+			EnableAutomaticUpdates: pulumi.Bool(true),
+			ProvisionVMAgent:       pulumi.Bool(true),
+		}
+		if vm.PatchMode != "" || vm.AssessmentMode != "" {
+			windowsConfiguration.PatchSettings = compute.PatchSettingsArgs{
+				AssessmentMode: stringPtr(vm.AssessmentMode),
+				PatchMode:      stringPtr(vm.PatchMode),
+			}
+		}
+		osProfile.WindowsConfiguration = windowsConfiguration
+	} else {
+		// Define the Linux configuration. Password authentication is disabled when SSH public keys are supplied.
+		linuxConfiguration := compute.LinuxConfigurationArgs{
+			DisablePasswordAuthentication: pulumi.Bool(len(vm.SshPublicKeys) > 0),
+			EnableVMAgentPlatformUpdates:  pulumi.Bool(true),
+			ProvisionVMAgent:              pulumi.Bool(true),
+		}
+		if vm.PatchMode != "" || vm.AssessmentMode != "" {
+			linuxConfiguration.PatchSettings = compute.LinuxPatchSettingsArgs{
+				AssessmentMode: stringPtr(vm.AssessmentMode),
+				PatchMode:      stringPtr(vm.PatchMode),
+			}
+		}
+		if len(vm.SshPublicKeys) > 0 {
+			var publicKeys compute.SshPublicKeyTypeArray
+			for _, key := range vm.SshPublicKeys {
+				publicKeys = append(publicKeys, compute.SshPublicKeyTypeArgs{
+					KeyData: pulumi.String(key),
+					Path:    pulumi.String("/home/" + vm.AdminUsername + "/.ssh/authorized_keys"),
+				})
+			}
+			linuxConfiguration.Ssh = &compute.SshConfigurationArgs{
+				PublicKeys: publicKeys,
+			}
+		}
+		osProfile.LinuxConfiguration = linuxConfiguration
+	}
+
+	// Define the VM's custom data, used for cloud-init or PAN-OS bootstrap. This sources from either inline config or a file on disk.
+	customData := vm.CustomData
+	if vm.CustomDataFile != "" {
+		customDataBytes, err := os.ReadFile(vm.CustomDataFile)
+		if err != nil {
+			return osProfile, fmt.Errorf("failed to read custom data file: %w", err)
+		}
+		customData = string(customDataBytes)
+	}
+	if customData != "" {
+		osProfile.CustomData = pulumi.String(base64.StdEncoding.EncodeToString([]byte(customData)))
+	}
+
+	// Point PAN-OS at the bootstrap file share, if configured, in place of the VM's own custom data.
+	if bootstrapCustomData != nil {
+		osProfile.CustomData = bootstrapCustomData
+	}
+	return osProfile, nil
+}
+
+// vmOsDisk returns a VM's OS disk, either created from the image, defaulting to a 127 GB read/write cached disk, or an
+// existing disk attached as it is, which must be in the VM's zone. Ephemeral OS disks are read-only cached.
+func vmOsDisk(ctx *pulumi.Context, vm VM, nameSuffix string, randomOsDiskId *random.RandomString) (compute.OSDiskArgs, error) {
+	osDiskCaching := compute.CachingTypesReadWrite
+	if vm.EphemeralOsDisk {
+		osDiskCaching = compute.CachingTypesReadOnly
+	}
+	if vm.OsDiskCaching != "" {
+		caching, err := cachingType(vm.OsDiskCaching)
+		if err != nil {
+			return compute.OSDiskArgs{}, fmt.Errorf("vm %q osDiskCaching: %w", vmKey(vm), err)
+		}
+		osDiskCaching = caching
+	}
+
+	// Define whether the OS disk is deleted or detached when the VM is deleted.
+	osDiskDeleteOption, err := deleteOption(vm.OsDiskDeleteOption)
+	if err != nil {
+		return compute.OSDiskArgs{}, fmt.Errorf("vm %q osDiskDeleteOption: %w", vmKey(vm), err)
+	}
+
+	// Attach an existing OS disk, after checking it is in the VM's zone.
+	if vm.OsDiskCreateOption == "Attach" {
+		match := managedDiskIdPattern.FindStringSubmatch(vm.OsDiskId)
+		existingOsDisk, err := compute.LookupDisk(ctx, &compute.LookupDiskArgs{
+			DiskName:          match[2],
+			ResourceGroupName: match[1],
+		})
+		if err != nil {
+			return compute.OSDiskArgs{}, fmt.Errorf("failed to read os disk %q of vm %q: %w", vm.OsDiskId, vmKey(vm), err)
+		}
+		if err := validateOsDiskZone(vm, existingOsDisk.Zones); err != nil {
+			return compute.OSDiskArgs{}, err
+		}
+		return compute.OSDiskArgs{
+			Caching:      osDiskCaching,
+			CreateOption: pulumi.String("Attach"),
+			DeleteOption: pulumi.String(osDiskDeleteOption),
+			ManagedDisk: compute.ManagedDiskParametersArgs{
+				Id: pulumi.String(vm.OsDiskId),
+			},
+			OsType:                  compute.OperatingSystemTypes(valueOrDefault(vm.OsType, "Linux")),
+			WriteAcceleratorEnabled: pulumi.Bool(vm.OsDiskWriteAcceleratorEnabled),
+		}, nil
+	}
+
+	// Place the OS disk on the VM's local cache or temp disk instead of managed storage, if ephemeral.
+	var diffDiskSettings compute.DiffDiskSettingsPtrInput
+	if vm.EphemeralOsDisk {
+		diffDiskSettings = compute.DiffDiskSettingsArgs{
+			Option:    pulumi.String("Local"),
+			Placement: pulumi.String(valueOrDefault(vm.EphemeralOsDiskPlacement, "CacheDisk")),
+		}
+	}
+	return compute.OSDiskArgs{
+		Caching:          osDiskCaching,
+		CreateOption:     pulumi.String("FromImage"),
+		DeleteOption:     pulumi.String(osDiskDeleteOption),
+		DiffDiskSettings: diffDiskSettings,
+		DiskSizeGB:       pulumi.Int(cmp.Or(vm.OsDiskSizeGB, 127)),
+		ManagedDisk: compute.ManagedDiskParametersArgs{
+			DiskEncryptionSet:  diskEncryptionSet(vm.DiskEncryptionSetId),
+			StorageAccountType: pulumi.String(vm.StorageAccountType),
+		},
+		Name:                    pulumi.Sprintf("%s%s", resourceName(nameSuffix, "os", vm.Name), randomOsDiskId.Result),
+		WriteAcceleratorEnabled: pulumi.Bool(vm.OsDiskWriteAcceleratorEnabled),
+	}, nil
+}
+
+// vmDataDisks returns a VM's data disks, named with the VM's disk name suffix and OS disk ID. Each defaults to the VM's
+// storage account type and disk encryption set.
+func vmDataDisks(vm VM, diskNameSuffix string, randomOsDiskId *random.RandomString) (compute.DataDiskArray, error) {
+	var dataDisks compute.DataDiskArray
+	for _, disk := range vm.DataDisks {
+		storageAccountType := disk.StorageAccountType
+		if storageAccountType == "" {
+			storageAccountType = vm.StorageAccountType
+		}
+		dataDiskDeleteOption, err := deleteOption(disk.DeleteOption)
+		if err != nil {
+			return nil, fmt.Errorf("data disk %q deleteOption: %w", disk.Name, err)
+		}
+		dataDiskArgs := compute.DataDiskArgs{
+			CreateOption: pulumi.String("Empty"),
+			DeleteOption: pulumi.String(dataDiskDeleteOption),
+			DiskSizeGB:   pulumi.Int(disk.DiskSizeGB),
+			Lun:          pulumi.Int(disk.Lun),
+			ManagedDisk: compute.ManagedDiskParametersArgs{
+				DiskEncryptionSet:  diskEncryptionSet(valueOrDefault(disk.DiskEncryptionSetId, vm.DiskEncryptionSetId)),
+				StorageAccountType: pulumi.String(storageAccountType),
+			},
+			Name:                    pulumi.Sprintf("data-%s-%s%s", disk.Name, diskNameSuffix, randomOsDiskId.Result),
+			WriteAcceleratorEnabled: pulumi.Bool(disk.WriteAcceleratorEnabled),
+		}
+		if disk.Caching != "" {
+			caching, err := cachingType(disk.Caching)
+			if err != nil {
+				return nil, fmt.Errorf("data disk %q: %w", disk.Name, err)
+			}
+			dataDiskArgs.Caching = caching
+		}
+		dataDisks = append(dataDisks, dataDiskArgs)
+	}
+	return dataDisks, nil
+}
+
+// vmAdditionalCapabilities enables UltraSSD support on a VM when any of its data disks use UltraSSD storage, and
+// hibernation when requested, or returns nil when neither is needed.
+func vmAdditionalCapabilities(vm VM) compute.AdditionalCapabilitiesPtrInput {
+	ultraSSDEnabled := slices.ContainsFunc(vm.DataDisks, func(disk DataDisk) bool { return disk.StorageAccountType == "UltraSSD_LRS" })
+	if !ultraSSDEnabled && !vm.HibernationEnabled {
+		return nil
+	}
+	capabilitiesArgs := compute.AdditionalCapabilitiesArgs{}
+	if ultraSSDEnabled {
+		capabilitiesArgs.UltraSSDEnabled = pulumi.Bool(true)
+	}
+	if vm.HibernationEnabled {
+		capabilitiesArgs.HibernationEnabled = pulumi.Bool(true)
+	}
+	return capabilitiesArgs
+}
+
+// vmSecurityProfile returns a VM's security profile, for trusted launch if a security type is configured, and for
+// encryption at host, which needs the EncryptionAtHost feature registered on the subscription. It returns nil for neither.
+func vmSecurityProfile(vm VM) compute.SecurityProfilePtrInput {
+	if vm.SecurityType == "" && !vm.EncryptionAtHost {
+		return nil
+	}
+	securityProfileArgs := compute.SecurityProfileArgs{}
+	if vm.SecurityType != "" {
+		securityProfileArgs.SecurityType = pulumi.String(vm.SecurityType)
+		securityProfileArgs.UefiSettings = compute.UefiSettingsArgs{
+			SecureBootEnabled: pulumi.Bool(vm.SecureBootEnabled),
+			VTpmEnabled:       pulumi.Bool(vm.VTpmEnabled),
+		}
+	}
+	if vm.EncryptionAtHost {
+		securityProfileArgs.EncryptionAtHost = pulumi.Bool(true)
+	}
+	return securityProfileArgs
+}
+
+// vmAvailabilitySet returns a VM's availability set, either an existing one by ID or one created for the first VM naming
+// it, and the created set for the VM to depend on, if any.
+func (d *deployment) vmAvailabilitySet(vm VM, availabilitySetMap map[string]*compute.AvailabilitySet) (compute.SubResourcePtrInput, pulumi.Resource, error) {
+	if availabilitySetResource, exists := availabilitySetMap[vm.AvailabilitySet.Name]; exists {
+		return compute.SubResourceArgs{Id: availabilitySetResource.ID()}, availabilitySetResource, nil
+	}
+	if vm.AvailabilitySet.Name == "" {
+		if vm.AvailabilitySetId == "" {
+			return nil, nil, nil
+		}
+		return compute.SubResourceArgs{Id: pulumi.String(vm.AvailabilitySetId)}, nil, nil
+	}
+
+	// Create the availability set for the first VM naming it.
+	logicalName := resourceName(d.plan.NameSuffix, "avail", vm.AvailabilitySet.Name)
+	availabilitySetArgs := &compute.AvailabilitySetArgs{
+		AvailabilitySetName: randomizedName(logicalName, d.randomNameSuffix),
+		Location:            stringPtr(d.location),
+		ResourceGroupName:   d.resourceGroup.Name,
+		Sku: &compute.SkuArgs{
+			Name: pulumi.String("Aligned"),
+		},
+		Tags: d.childTags(vm.Tags),
+	}
+	if vm.AvailabilitySet.PlatformFaultDomainCount != 0 {
+		availabilitySetArgs.PlatformFaultDomainCount = pulumi.Int(vm.AvailabilitySet.PlatformFaultDomainCount)
+	}
+	if vm.AvailabilitySet.PlatformUpdateDomainCount != 0 {
+		availabilitySetArgs.PlatformUpdateDomainCount = pulumi.Int(vm.AvailabilitySet.PlatformUpdateDomainCount)
+	}
+	availabilitySetResource, err := compute.NewAvailabilitySet(d.ctx, logicalName, availabilitySetArgs,
+		pulumi.DependsOn([]pulumi.Resource{d.resourceGroup}),
+		d.parentOf(d.resourceGroup),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.addInventory("Microsoft.Compute/availabilitySets", availabilitySetResource)
+	availabilitySetMap[vm.AvailabilitySet.Name] = availabilitySetResource
+	return compute.SubResourceArgs{Id: availabilitySetResource.ID()}, availabilitySetResource, nil
+}
+
+// vmImage returns a VM's image reference and marketplace plan, and the image properties to ignore changes to. With
+// pinLatest, a "latest" marketplace version or an unversioned gallery image is resolved to the newest version.
+func (d *deployment) vmImage(vm VM) (compute.ImageReferencePtrInput, compute.PlanPtrInput, []string, error) {
+	var imageReference compute.ImageReferencePtrInput
+	var ignoredVmChanges []string
+	switch {
+	case vm.OsDiskCreateOption == "Attach":
+	case vm.Image.Id != "":
+		imageId := vm.Image.Id
+		if d.plan.PinLatest && isUnversionedGalleryImage(imageId) {
+			var err error
+			imageId, err = resolveGalleryImageVersion(d.ctx, d.plan.ResourceManagerEndpoint, vm)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			ignoredVmChanges = []string{"storageProfile.imageReference.id"}
+		}
+		imageReference = compute.ImageReferenceArgs{
+			Id: pulumi.String(imageId),
+		}
+	default:
+		imageVersion := vm.Image.Version
+		if d.plan.PinLatest && strings.EqualFold(imageVersion, "latest") {
+			var err error
+			imageVersion, err = resolveImageVersion(d.ctx, d.plan.ResourceManagerEndpoint, d.location, vm)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			ignoredVmChanges = []string{"storageProfile.imageReference.version"}
+		}
+		imageReference = compute.ImageReferenceArgs{
+			Offer:     pulumi.String(vm.Image.Offer),
+			Publisher: pulumi.String(vm.Image.Publisher),
+			Sku:       pulumi.String(vm.Image.Sku),
+			Version:   pulumi.String(imageVersion),
+		}
+	}
+
+	// Images sold through the marketplace, or built from one, need a plan, while first-party images have none.
+	var purchasePlan compute.PlanPtrInput
+	if vmPlan, required := imagePlan(vm.Image); required {
+		purchasePlan = &compute.PlanArgs{
+			Name:      pulumi.String(vmPlan.Name),
+			Product:   pulumi.String(vmPlan.Product),
+			Publisher: pulumi.String(vmPlan.Publisher),
+		}
+	}
+	return imageReference, purchasePlan, ignoredVmChanges, nil
+}
+
+// exportSummary exports the Public IP addresses, a JSON-serializable summary of the deployment, the destroy checklist, the
+// topology diagram and the inventory of created resources.
+func (d *deployment) exportSummary() {
+	ctx, vnet := d.ctx, d.plan.VNET
+
+	// Export the Public IP addresses, keyed by Public IP name. IPv6 addresses are exported separately from IPv4 ones.
+	publicIpAddresses := pulumi.StringMap{}
+	publicIpv6Addresses := pulumi.StringMap{}
+	for _, pip := range vnet.PIP {
+		if pip.Version == "IPv6" {
+			publicIpv6Addresses[pip.Name] = d.pipMap[pip.Name].IpAddress.Elem()
+		} else {
+			publicIpAddresses[pip.Name] = d.pipMap[pip.Name].IpAddress.Elem()
+		}
+	}
+	ctx.Export("publicIpAddresses", publicIpAddresses)
+	ctx.Export("publicIpv6Addresses", publicIpv6Addresses)
+
+	// Export a summary of the deployment for downstream automation, once every resource it references exists.
+	nicPrivateIpAddresses := pulumi.StringMap{}
+	for _, name := range slices.Sorted(maps.Keys(d.nicMap)) {
+		nicPrivateIpAddresses[name] = d.nicMap[name].IpConfigurations.Index(pulumi.Int(0)).PrivateIPAddress().Elem()
+	}
+	ctx.Export("summary", pulumi.All(d.resourceGroup.Name, d.virtualNetwork.Name, nicPrivateIpAddresses, publicIpAddresses, d.vmSummaries).ApplyT(
+		func(args []interface{}) map[string]interface{} {
+			subnets := []map[string]interface{}{}
+			for _, snet := range vnet.SNET {
+				subnets = append(subnets, map[string]interface{}{
+					"addressPrefixes": subnetAddressPrefixes(snet),
+					"name":            snet.Name,
+				})
+			}
+			return map[string]interface{}{
+				"nics":              args[2],
+				"publicIpAddresses": args[3],
+				"resourceGroupName": args[0],
+				"subnets":           subnets,
+				"virtualMachines":   args[4],
+				"virtualNetwork": map[string]interface{}{
+					"addressSpace":  vnet.AddressSpace,
+					"addressSpaces": virtualNetworkAddressSpaces(vnet),
+					"name":          args[1],
+				},
+			}
+		},
+	))
+
+	// Export a checklist of the data lost on "pulumi destroy", to review before destroying the stack.
+	ctx.Export("destructiveChanges", pulumi.ToStringArray(auditDestructiveChanges(vnet, d.plan.VMs, d.plan.ProtectResources)))
+
+	// Export a Graphviz dot diagram of the deployment's topology.
+	ctx.Export("topology", pulumi.String(buildTopologyDot(vnet, d.plan.VMs)))
+
+	// Export an inventory of the created resources as JSON, sorted by type and ID. Bump schemaVersion on any schema change.
+	inventoryTypes := d.inventoryTypes
+	ctx.Export("inventory", pulumi.All(d.inventoryIds...).ApplyT(func(ids []interface{}) (string, error) {
+		inventory := Inventory{
+			Resources:     []InventoryResource{},
+			SchemaVersion: 1,
+		}
+		for i, id := range ids {
+			resourceId := string(id.(pulumi.ID))
+			inventory.Resources = append(inventory.Resources, InventoryResource{
+				Id:   resourceId,
+				Name: resourceId[strings.LastIndex(resourceId, "/")+1:],
+				Type: inventoryTypes[i],
+			})
+		}
+		slices.SortFunc(inventory.Resources, func(a, b InventoryResource) int {
+			return cmp.Or(strings.Compare(a.Type, b.Type), strings.Compare(a.Id, b.Id))
+		})
+		inventoryJson, err := json.Marshal(inventory)
+		if err != nil {
+			return "", fmt.Errorf("failed to serialize inventory: %w", err)
+		}
+		return string(inventoryJson), nil
+	}))
+}
+
+// defaultAcceleratedNetworkingVmSizes lists the VM sizes known to support accelerated networking, covering the sizes
+// Palo Alto Networks supports for the VM-Series.
+var defaultAcceleratedNetworkingVmSizes = []string{
+	"Standard_D3_v2",
+	"Standard_D4_v2",
+	"Standard_D5_v2",
+	"Standard_DS3_v2",
+	"Standard_DS4_v2",
+	"Standard_DS5_v2",
+	"Standard_D4_v3",
+	"Standard_D8_v3",
+	"Standard_D16_v3",
+	"Standard_D4s_v3",
+	"Standard_D8s_v3",
+	"Standard_D16s_v3",
+	"Standard_D4_v4",
+	"Standard_D8_v4",
+	"Standard_D16_v4",
+	"Standard_D4s_v4",
+	"Standard_D8s_v4",
+	"Standard_D16s_v4",
+	"Standard_D4s_v5",
+	"Standard_D8s_v5",
+	"Standard_D16s_v5",
+	"Standard_D4ds_v5",
+	"Standard_D8ds_v5",
+	"Standard_D16ds_v5",
+	"Standard_F4s_v2",
+	"Standard_F8s_v2",
+	"Standard_F16s_v2",
+	"Standard_F32s_v2",
+}
+
+// resourceNameLimits holds the Azure name length limit for each resource kind named via resourceName.
+var resourceNameLimits = map[string]int{
+	"agw":   80,
+	"asg":   80,
+	"avail": 80,
+	"bas":   80,
+	"ext":   80,
+	"fl":    80,
+	"lb":    80,
+	"ng":    80,
+	"nic":   80,
+	"nsg":   80,
+	"os":    80,
+	"pip":   80,
+	"rg":    90,
+	"rt":    80,
+	"share": 63,
+	"st":    24,
+	"terms": 64,
+	"vm":    64,
+	"vnet":  64,
+}
+
+// autonameSuffixLength is the length of the random suffix Pulumi appends to a resource's logical name when auto-naming it.
+// The shared suffix used by randomizedName is the same length, so names truncated by resourceName fit either way.
+const autonameSuffixLength = 8
+
+// resourceName builds the logical name for a resource in the form "<kind>-[<name>-]<nameSuffix>". Names that would exceed
+// the Azure limit for the kind once auto-named are truncated, with a short hash of the full name keeping them unique.
+func resourceName(nameSuffix, kind, name string) string {
+	fullName := kind + "-" + nameSuffix
+	if name != "" {
+		fullName = kind + "-" + name + "-" + nameSuffix
+	}
+
+	limit, exists := resourceNameLimits[kind]
+	if !exists || len(fullName)+autonameSuffixLength <= limit {
+		return fullName
+	}
+	hash := sha256.Sum256([]byte(fullName))
+	hashSuffix := hex.EncodeToString(hash[:])[:6] + "-"
+	return fullName[:limit-autonameSuffixLength-len(hashSuffix)] + hashSuffix
+}
+
+// exportIds exports the ID of each named resource as "ids:<kind>:<name>", giving downstream stacks stable references. An
+// empty map exports nothing. The exports are registered in name order, so previews list them the same way every run.
+func exportIds[T pulumi.CustomResource](ctx *pulumi.Context, kind string, named map[string]T) {
+	for _, name := range slices.Sorted(maps.Keys(named)) {
+		ctx.Export(fmt.Sprintf("ids:%s:%s", kind, name), named[name].ID())
+	}
+}
+
+// agentReadyTimeout bounds how long waitForAgentReady polls a VM's instance view, and agentReadyPollInterval how often.
+const (
+	agentReadyTimeout      = 15 * time.Minute
+	agentReadyPollInterval = 15 * time.Second
+)
+
+// waitForAgentReady polls a VM's instance view until its VM agent reports ready, returning false with a warning if it
+// doesn't within agentReadyTimeout, so a VM whose agent never starts can't hang the update. It blocks, so it must only
+// be called from an apply on an update, and stops early if the update is cancelled.
+func waitForAgentReady(ctx *pulumi.Context, resourceGroupName, vmName string) (bool, error) {
+	expand := "instanceView"
+	deadline := time.Now().Add(agentReadyTimeout)
+	for {
+		result, err := compute.LookupVirtualMachine(ctx, &compute.LookupVirtualMachineArgs{
+			Expand:            &expand,
+			ResourceGroupName: resourceGroupName,
+			VmName:            vmName,
+		})
+		if err != nil {
+			return false, fmt.Errorf("failed to read the instance view of vm %q: %w", vmName, err)
+		}
+		if vmAgent := result.InstanceView.VmAgent; vmAgent != nil {
+			for _, status := range vmAgent.Statuses {
+				if status.DisplayStatus != nil && *status.DisplayStatus == "Ready" {
+					return true, nil
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			ctx.Log.Warn(fmt.Sprintf("vm %q agent was not ready after %s", vmName, agentReadyTimeout), nil)
+			return false, nil
+		}
+		select {
+		case <-ctx.Context().Done():
+			return false, ctx.Context().Err()
+		case <-time.After(agentReadyPollInterval):
+		}
+	}
+}
+
+// customTimeouts checks that the configured create, update and delete timeouts are valid durations, returning nil when
+// none are set so the provider's defaults apply.
+func customTimeouts(timeouts CustomTimeouts) (*pulumi.CustomTimeouts, error) {
+	if timeouts == (CustomTimeouts{}) {
+		return nil, nil
+	}
+	for _, timeout := range []struct{ name, value string }{
+		{"create", timeouts.Create},
+		{"delete", timeouts.Delete},
+		{"update", timeouts.Update},
+	} {
+		if timeout.value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(timeout.value); err != nil {
+			return nil, fmt.Errorf("customTimeouts.%s %q is not a valid duration: %w", timeout.name, timeout.value, err)
+		}
+	}
+	return &pulumi.CustomTimeouts{
+		Create: timeouts.Create,
+		Delete: timeouts.Delete,
+		Update: timeouts.Update,
+	}, nil
+}
+
+// vmKey returns the name used to identify a VM in errors and stack outputs, falling back to its computer name.
+func vmKey(vm VM) string {
+	if vm.Name != "" {
+		return vm.Name
+	}
+	return vm.ComputerName
+}
+
+// deleteOption validates a disk delete option from configuration, defaulting to "Delete" so disks are removed with the VM.
+// "Detach" keeps the disk when the VM is deleted.
+func deleteOption(option string) (string, error) {
+	switch option {
+	case "":
+		return "Delete", nil
+	case "Delete", "Detach":
+		return option, nil
+	}
+	return "", fmt.Errorf("unknown delete option %q, expected Delete or Detach", option)
+}
+
+// publicIpZones returns the availability zones of a Public IP: all three when it is zone-redundant, otherwise the zones it
+// is pinned to, if any.
+func publicIpZones(pip PIP) []string {
+	if pip.ZoneRedundant {
+		return []string{"1", "2", "3"}
+	}
+	return pip.Zones
+}
+
+// domainNameLabelPattern matches the DNS labels Azure accepts for Public IPs.
+var domainNameLabelPattern = regexp.MustCompile(`^[a-z][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// validatePublicIP checks a Public IP's allocation method, SKU, zones, DNS settings and idle timeout against the values Azure
+// accepts.
+func validatePublicIP(pip PIP) error {
+	allocationMethod := valueOrDefault(pip.AllocationMethod, "Static")
+	if allocationMethod != "Static" && allocationMethod != "Dynamic" {
+		return fmt.Errorf("public ip %q has unknown allocationMethod %q", pip.Name, allocationMethod)
+	}
+
+	if pip.ZoneRedundant && len(pip.Zones) > 0 {
+		return fmt.Errorf("public ip %q cannot set both zoneRedundant and zones", pip.Name)
+	}
+
+	skuName := valueOrDefault(pip.SkuName, "Standard")
+	switch skuName {
+	case "Basic":
+		if pip.ZoneRedundant {
+			return fmt.Errorf("public ip %q uses the Basic sku, which does not support zoneRedundant", pip.Name)
+		}
+		if len(pip.Zones) > 0 {
+			return fmt.Errorf("public ip %q uses the Basic sku, which does not support zones", pip.Name)
+		}
+	case "Standard":
+		if allocationMethod != "Static" {
+			return fmt.Errorf("public ip %q uses the Standard sku, which requires the Static allocationMethod", pip.Name)
+		}
+	default:
+		return fmt.Errorf("public ip %q has unknown skuName %q", pip.Name, skuName)
+	}
+
+	switch valueOrDefault(pip.Version, "IPv4") {
+	case "IPv4":
+	case "IPv6":
+		if skuName != "Standard" {
+			return fmt.Errorf("public ip %q is IPv6, which requires the Standard sku", pip.Name)
+		}
+	default:
+		return fmt.Errorf("public ip %q has unknown version %q, expected IPv4 or IPv6", pip.Name, pip.Version)
+	}
+
+	skuTier := valueOrDefault(pip.SkuTier, "Regional")
+	if skuTier != "Regional" && skuTier != "Global" {
+		return fmt.Errorf("public ip %q has unknown skuTier %q", pip.Name, skuTier)
+	}
+
+	if pip.DomainNameLabel != "" && !domainNameLabelPattern.MatchString(pip.DomainNameLabel) {
+		return fmt.Errorf("public ip %q domainNameLabel %q must be 3-63 lowercase letters, digits or hyphens, starting with a letter", pip.Name, pip.DomainNameLabel)
+	}
+	if pip.ReverseFqdn != "" {
+		if pip.DomainNameLabel == "" {
+			return fmt.Errorf("public ip %q reverseFqdn requires domainNameLabel to be set", pip.Name)
+		}
+		if !isHostname(pip.ReverseFqdn) {
+			return fmt.Errorf("public ip %q reverseFqdn %q is not a valid hostname", pip.Name, pip.ReverseFqdn)
+		}
+	}
+
+	if pip.IdleTimeoutInMinutes != 0 && (pip.IdleTimeoutInMinutes < 4 || pip.IdleTimeoutInMinutes > 30) {
+		return fmt.Errorf("public ip %q idleTimeoutInMinutes %d is outside the allowed range of 4-30", pip.Name, pip.IdleTimeoutInMinutes)
+	}
+	return nil
+}
+
+// hostnameLabelPattern matches a single label of a hostname.
+var hostnameLabelPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// isHostname reports whether name is a valid hostname of at most 253 characters, optionally fully qualified with a
+// trailing dot.
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for label := range strings.SplitSeq(name, ".") {
+		if !hostnameLabelPattern.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateLoadBalancer checks that the load balancer's frontend subnet and backend NICs exist, and that its probe and rule
+// ports are in range. Rules using the "All" protocol are HA ports rules, which use port 0.
+func validateLoadBalancer(lb LB, vnet VNET) error {
+	if !slices.ContainsFunc(vnet.SNET, func(snet SNET) bool { return snet.Name == lb.FrontendSnetName }) {
+		return fmt.Errorf("load balancer %q references unknown frontend subnet %q", lb.Name, lb.FrontendSnetName)
+	}
+	for _, nicName := range lb.BackendNics {
+		index := slices.IndexFunc(vnet.NIC, func(nic NIC) bool { return nic.Name == nicName })
+		if index < 0 {
+			return fmt.Errorf("load balancer %q references unknown backend nic %q", lb.Name, nicName)
+		}
+		if vnet.NIC[index].Existing {
+			return fmt.Errorf("load balancer %q backend nic %q is existing, so can't be added to the backend pool", lb.Name, nicName)
+		}
+	}
+	return validateLoadBalancerRules(lb.Name, lb.Probe, lb.Rules)
+}
+
+// validateLoadBalancerRules checks that a load balancer's probe and rule ports are in range. HA ports rules, with the All
+// protocol, use port 0.
+func validateLoadBalancerRules(name string, probe Probe, rules []LBRule) error {
+	if probe.Port < 1 || probe.Port > 65535 {
+		return fmt.Errorf("load balancer %q probe port %d is outside the allowed range of 1-65535", name, probe.Port)
+	}
+	for _, rule := range rules {
+		minPort := 1
+		if rule.Protocol == "All" {
+			minPort = 0
+		}
+		for _, port := range []int{rule.FrontendPort, rule.BackendPort} {
+			if port < minPort || port > 65535 {
+				return fmt.Errorf("load balancer %q rule %q port %d is outside the allowed range of %d-65535", name, rule.Name, port, minPort)
+			}
+		}
+	}
+	return nil
+}
+
+// storageAccountNamePattern matches the names Azure allows for storage accounts: 3-24 lowercase letters and digits.
+var storageAccountNamePattern = regexp.MustCompile(`^[a-z0-9]{3,24}$`)
+
+// fileShareNamePattern matches the names Azure allows for file shares: 3-63 lowercase letters, digits and hyphens, starting
+// and ending with a letter or digit. Consecutive hyphens are checked separately.
+var fileShareNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// validateBootstrap checks the bootstrap storage account and file share names against Azure's rules, and that the subnet
+// allowed to reach the storage account exists and has the Microsoft.Storage service endpoint.
+func validateBootstrap(bootstrap Bootstrap, vnet VNET) error {
+	if !storageAccountNamePattern.MatchString(bootstrap.StorageAccountName) {
+		return fmt.Errorf("bootstrap storageAccountName %q must be 3-24 lowercase letters or digits", bootstrap.StorageAccountName)
+	}
+	if !fileShareNamePattern.MatchString(bootstrap.FileShare) || strings.Contains(bootstrap.FileShare, "--") {
+		return fmt.Errorf("bootstrap fileShare %q must be 3-63 lowercase letters, digits or single hyphens, starting and ending with a letter or digit", bootstrap.FileShare)
+	}
+	if bootstrap.SnetName != "" {
+		index := slices.IndexFunc(vnet.SNET, func(snet SNET) bool { return snet.Name == bootstrap.SnetName })
+		if index < 0 {
+			return fmt.Errorf("bootstrap references unknown subnet %q", bootstrap.SnetName)
+		}
+		if !vnet.SNET[index].Existing && !containsFold(vnet.SNET[index].ServiceEndpoints, "Microsoft.Storage") {
+			return fmt.Errorf("bootstrap subnet %q requires the Microsoft.Storage service endpoint", bootstrap.SnetName)
+		}
+	}
+	return nil
+}
+
+// bootstrapUserData returns the PAN-OS custom data pointing the firewall at its bootstrap file share.
+func bootstrapUserData(bootstrap Bootstrap, accessKey string) string {
+	userData := fmt.Sprintf("storage-account=%s;access-key=%s;file-share=%s", bootstrap.StorageAccountName, accessKey, bootstrap.FileShare)
+	if bootstrap.ShareDirectory != "" {
+		userData += ";share-directory=" + bootstrap.ShareDirectory
+	}
+	return userData
+}
+
+// validateApplicationGateway checks that an Application Gateway's subnet, Public IP and backend NIC exist, that its subnet is
+// dedicated to it, that its certificates and identity are set, and that its SKU, capacity, ports and backend protocol are
+// valid.
+func validateApplicationGateway(agw ApplicationGateway, vnet VNET) error {
+	index := slices.IndexFunc(vnet.SNET, func(snet SNET) bool { return snet.Name == agw.SnetName })
+	if index < 0 {
+		return fmt.Errorf("application gateway %q references unknown subnet %q", agw.Name, agw.SnetName)
+	}
+	if len(vnet.SNET[index].Delegations) > 0 {
+		return fmt.Errorf("application gateway %q requires a dedicated subnet, but subnet %q is delegated", agw.Name, agw.SnetName)
+	}
+	if vnet.LoadBalancer.Name != "" && vnet.LoadBalancer.FrontendSnetName == agw.SnetName {
+		return fmt.Errorf("application gateway %q requires a dedicated subnet, but subnet %q is the frontend of load balancer %q", agw.Name, agw.SnetName, vnet.LoadBalancer.Name)
+	}
+	for _, nic := range vnet.NIC {
+		for _, ipConfig := range nic.IpConfigurations {
+			if ipConfig.SnetName == agw.SnetName {
+				return fmt.Errorf("application gateway %q requires a dedicated subnet, but nic %q uses subnet %q", agw.Name, nic.Name, agw.SnetName)
+			}
+		}
+	}
+
+	index = slices.IndexFunc(vnet.PIP, func(pip PIP) bool { return pip.Name == agw.FrontendPipName })
+	if index < 0 {
+		return fmt.Errorf("application gateway %q references unknown frontend public ip %q", agw.Name, agw.FrontendPipName)
+	}
+	if valueOrDefault(vnet.PIP[index].SkuName, "Standard") != "Standard" {
+		return fmt.Errorf("application gateway %q frontend public ip %q must use the Standard sku", agw.Name, agw.FrontendPipName)
+	}
+	if !slices.ContainsFunc(vnet.NIC, func(nic NIC) bool { return nic.Name == agw.BackendNicName }) {
+		return fmt.Errorf("application gateway %q references unknown backend nic %q", agw.Name, agw.BackendNicName)
+	}
+
+	if !keyVaultSecretIdPattern.MatchString(agw.CertificateSecretId) {
+		return fmt.Errorf("application gateway %q certificateSecretId %q is not a Key Vault secret id", agw.Name, agw.CertificateSecretId)
+	}
+	if agw.TrustedRootCertificateSecretId != "" && !keyVaultSecretIdPattern.MatchString(agw.TrustedRootCertificateSecretId) {
+		return fmt.Errorf("application gateway %q trustedRootCertificateSecretId %q is not a Key Vault secret id", agw.Name, agw.TrustedRootCertificateSecretId)
+	}
+	if !userAssignedIdentityIdPattern.MatchString(agw.IdentityId) {
+		return fmt.Errorf("application gateway %q identityId %q is not a user-assigned identity id", agw.Name, agw.IdentityId)
+	}
+
+	if skuName := valueOrDefault(agw.SkuName, "Standard_v2"); skuName != "Standard_v2" && skuName != "WAF_v2" {
+		return fmt.Errorf("application gateway %q has unknown skuName %q, expected Standard_v2 or WAF_v2", agw.Name, agw.SkuName)
+	}
+	if agw.Capacity < 0 || agw.Capacity > 125 {
+		return fmt.Errorf("application gateway %q capacity %d is outside the allowed range of 1-125, or 0 for the default of 2", agw.Name, agw.Capacity)
+	}
+	for _, port := range []int{agw.FrontendPort, agw.BackendPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("application gateway %q port %d is outside the allowed range of 1-65535, or 0 for the default of 443", agw.Name, port)
+		}
+	}
+	if backendProtocol := valueOrDefault(agw.BackendProtocol, "Https"); backendProtocol != "Http" && backendProtocol != "Https" {
+		return fmt.Errorf("application gateway %q has unknown backendProtocol %q, expected Http or Https", agw.Name, agw.BackendProtocol)
+	}
+	return nil
+}
+
+// userAssignedIdentityIdPattern loosely matches the resource ID of a user-assigned managed identity.
+var userAssignedIdentityIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.ManagedIdentity/userAssignedIdentities/[^/]+$`)
+
+// loadBalancerProbeArgs returns the arguments for a load balancer health probe, leaving unset settings to Azure's defaults.
+func loadBalancerProbeArgs(probe Probe, name string) network.ProbeArgs {
+	probeArgs := network.ProbeArgs{
+		Name:     pulumi.String(name),
+		Port:     pulumi.Int(probe.Port),
+		Protocol: pulumi.String(valueOrDefault(probe.Protocol, "Tcp")),
+	}
+	if probe.IntervalInSeconds != 0 {
+		probeArgs.IntervalInSeconds = pulumi.Int(probe.IntervalInSeconds)
+	}
+	if probe.NumberOfProbes != 0 {
+		probeArgs.NumberOfProbes = pulumi.Int(probe.NumberOfProbes)
+	}
+	if probe.RequestPath != "" {
+		probeArgs.RequestPath = pulumi.String(probe.RequestPath)
+	}
+	return probeArgs
+}
+
+// loadBalancingRuleArgs returns the arguments for a load balancing rule between a frontend and backend pool, using a probe.
+func loadBalancingRuleArgs(rule LBRule, frontendId, backendPoolId, probeId pulumi.StringInput) network.LoadBalancingRuleArgs {
+	ruleArgs := network.LoadBalancingRuleArgs{
+		BackendAddressPool: &network.SubResourceArgs{
+			Id: backendPoolId,
+		},
+		BackendPort:      pulumi.Int(rule.BackendPort),
+		EnableFloatingIP: pulumi.Bool(rule.EnableFloatingIP),
+		FrontendIPConfiguration: &network.SubResourceArgs{
+			Id: frontendId,
+		},
+		FrontendPort: pulumi.Int(rule.FrontendPort),
+		Name:         pulumi.String(rule.Name),
+		Probe: &network.SubResourceArgs{
+			Id: probeId,
+		},
+		Protocol: pulumi.String(rule.Protocol),
+	}
+	if rule.IdleTimeoutInMinutes != 0 {
+		ruleArgs.IdleTimeoutInMinutes = pulumi.Int(rule.IdleTimeoutInMinutes)
+	}
+	return ruleArgs
+}
+
+// haPairDataplaneNics returns the dataplane NIC of each VM in an HA pair, taken from the NIC map slot named by dataplaneNic,
+// nic1 by default. VMs that don't exist, or have no NIC in that slot, are skipped.
+func haPairDataplaneNics(haPair HaPair, vms []VM) []string {
+	var nicNames []string
+	for _, vmName := range haPair.VmNames {
+		index := slices.IndexFunc(vms, func(vm VM) bool { return vmKey(vm) == vmName })
+		if index < 0 {
+			continue
+		}
+		nicMap := vms[index].NicMap
+		var nicName string
+		switch strings.ToLower(valueOrDefault(haPair.DataplaneNic, "nic1")) {
+		case "nic0":
+			nicName = nicMap.Nic0
+		case "nic1":
+			nicName = nicMap.Nic1
+		case "nic2":
+			nicName = nicMap.Nic2
+		}
+		if nicName != "" {
+			nicNames = append(nicNames, nicName)
+		}
+	}
+	return nicNames
+}
+
+// validateOutboundRule checks that an outbound rule's Public IP exists and uses the Standard sku, that its backend NICs
+// exist and aren't existing ones, and that its allocated ports and idle timeout are within Azure's limits. Allocated
+// ports are shared out per backend instance, so must be a multiple of 8.
+func validateOutboundRule(outboundRule OutboundRule, vnet VNET) error {
+	index := slices.IndexFunc(vnet.PIP, func(pip PIP) bool { return pip.Name == outboundRule.PipName })
+	if index < 0 {
+		return fmt.Errorf("outbound rule %q references unknown public ip %q", outboundRule.Name, outboundRule.PipName)
+	}
+	if valueOrDefault(vnet.PIP[index].SkuName, "Standard") != "Standard" {
+		return fmt.Errorf("outbound rule %q public ip %q must use the Standard sku", outboundRule.Name, outboundRule.PipName)
+	}
+	if valueOrDefault(vnet.PIP[index].Version, "IPv4") != "IPv4" {
+		return fmt.Errorf("outbound rule %q public ip %q must be IPv4", outboundRule.Name, outboundRule.PipName)
+	}
+
+	if len(outboundRule.BackendNics) == 0 {
+		return fmt.Errorf("outbound rule %q requires at least one backend nic", outboundRule.Name)
+	}
+	for _, nicName := range outboundRule.BackendNics {
+		index := slices.IndexFunc(vnet.NIC, func(nic NIC) bool { return nic.Name == nicName })
+		if index < 0 {
+			return fmt.Errorf("outbound rule %q references unknown backend nic %q", outboundRule.Name, nicName)
+		}
+		if vnet.NIC[index].Existing {
+			return fmt.Errorf("outbound rule %q backend nic %q is existing, so can't be added to the backend pool", outboundRule.Name, nicName)
+		}
+	}
+
+	if outboundRule.AllocatedOutboundPorts < 0 || outboundRule.AllocatedOutboundPorts > 64000 || outboundRule.AllocatedOutboundPorts%8 != 0 {
+		return fmt.Errorf("outbound rule %q allocatedOutboundPorts %d must be a multiple of 8 between 0 and 64000", outboundRule.Name, outboundRule.AllocatedOutboundPorts)
+	}
+	if outboundRule.IdleTimeoutInMinutes != 0 && (outboundRule.IdleTimeoutInMinutes < 4 || outboundRule.IdleTimeoutInMinutes > 120) {
+		return fmt.Errorf("outbound rule %q idleTimeoutInMinutes %d is outside the allowed range of 4-120", outboundRule.Name, outboundRule.IdleTimeoutInMinutes)
+	}
+	return nil
+}
+
+// bastionSubnetName is the name Azure requires for the subnet of a Bastion host.
+const bastionSubnetName = "AzureBastionSubnet"
+
+// validateBastion checks that a Bastion host has a dedicated AzureBastionSubnet of at least a /26, without the network
+// security group or route table Bastion doesn't support, and a Standard, static, IPv4 Public IP. An existing subnet's
+// prefixes are unknown, so aren't checked.
+func validateBastion(bastion Bastion, vnet VNET) error {
+	index := slices.IndexFunc(vnet.SNET, func(snet SNET) bool { return snet.Name == bastionSubnetName })
+	if index < 0 {
+		return fmt.Errorf("bastion %q requires subnet %q, either configured or created from its addressPrefix", bastion.Name, bastionSubnetName)
+	}
+	snet := vnet.SNET[index]
+	if snet.NSGName != "" || snet.RTName != "" {
+		return fmt.Errorf("bastion %q subnet %q cannot have a network security group or route table", bastion.Name, bastionSubnetName)
+	}
+	if len(snet.Delegations) > 0 {
+		return fmt.Errorf("bastion %q requires a dedicated subnet, but subnet %q is delegated", bastion.Name, bastionSubnetName)
+	}
+	for _, addressPrefix := range append([]string{snet.AddressPrefix}, snet.AddressPrefixes...) {
+		if addressPrefix == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(addressPrefix)
+		if err != nil {
+			return fmt.Errorf("bastion %q subnet %q address prefix %q is not a valid cidr: %w", bastion.Name, bastionSubnetName, addressPrefix, err)
+		}
+		if prefix.Addr().Is4() && prefix.Bits() > 26 {
+			return fmt.Errorf("bastion %q subnet %q address prefix %q must be at least a /26", bastion.Name, bastionSubnetName, addressPrefix)
+		}
+	}
+	for _, nic := range vnet.NIC {
+		for _, ipConfig := range nic.IpConfigurations {
+			if ipConfig.SnetName == bastionSubnetName {
+				return fmt.Errorf("bastion %q requires a dedicated subnet, but nic %q uses subnet %q", bastion.Name, nic.Name, bastionSubnetName)
+			}
+		}
+	}
+
+	index = slices.IndexFunc(vnet.PIP, func(pip PIP) bool { return pip.Name == bastion.PipName })
+	if index < 0 {
+		return fmt.Errorf("bastion %q references unknown public ip %q", bastion.Name, bastion.PipName)
+	}
+	pip := vnet.PIP[index]
+	if valueOrDefault(pip.SkuName, "Standard") != "Standard" || valueOrDefault(pip.AllocationMethod, "Static") != "Static" || valueOrDefault(pip.Version, "IPv4") != "IPv4" {
+		return fmt.Errorf("bastion %q public ip %q must be a Standard, Static, IPv4 public ip", bastion.Name, bastion.PipName)
+	}
+
+	if !slices.Contains([]string{"", "Basic", "Standard", "Premium"}, bastion.SkuName) {
+		return fmt.Errorf("bastion %q has unknown skuName %q, expected Basic, Standard or Premium", bastion.Name, bastion.SkuName)
+	}
+	return nil
+}
+
+// resourceManagerEndpoints maps the provider's Azure environments to their Resource Manager endpoints.
+var resourceManagerEndpoints = map[string]string{
+	"china":        "https://management.chinacloudapi.cn",
+	"public":       "https://management.azure.com",
+	"usgovernment": "https://management.usgovcloudapi.net",
+}
+
+// getResourceManager decodes the response to a Resource Manager GET request for path at endpoint into result. The SDK has
+// no lookups for image versions, so they are read directly, with a token for the provider's own credentials.
+func getResourceManager(ctx *pulumi.Context, endpoint, path string, result any) error {
+	var token struct {
+		Token string `pulumi:"token"`
+	}
+	if err := ctx.Invoke("azure-native:authorization:getClientToken", nil, &token); err != nil {
+		return fmt.Errorf("failed to get a resource manager token: %w", err)
+	}
+	request, err := http.NewRequestWithContext(ctx.Context(), http.MethodGet, endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+token.Token)
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("resource manager returned %s", response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// resolveImageVersion returns the newest version of a VM's marketplace image published in a location. It fails if the
+// image has no versions, rather than falling back to "latest".
+func resolveImageVersion(ctx *pulumi.Context, endpoint, location string, vm VM) (string, error) {
+	image := fmt.Sprintf("%s/%s/%s", vm.Image.Publisher, vm.Image.Offer, vm.Image.Sku)
+	var clientConfig struct {
+		SubscriptionId string `pulumi:"subscriptionId"`
+	}
+	if err := ctx.Invoke("azure-native:authorization:getClientConfig", nil, &clientConfig); err != nil {
+		return "", fmt.Errorf("failed to read the subscription to resolve vm %q image %s: %w", vmKey(vm), image, err)
+	}
+	var versions []struct {
+		Name string `json:"name"`
+	}
+	path := fmt.Sprintf("/subscriptions/%s/providers/Microsoft.Compute/locations/%s/publishers/%s/artifacttypes/vmimage/offers/%s/skus/%s/versions?api-version=2024-07-01",
+		clientConfig.SubscriptionId, location, vm.Image.Publisher, vm.Image.Offer, vm.Image.Sku)
+	if err := getResourceManager(ctx, endpoint, path, &versions); err != nil {
+		return "", fmt.Errorf("failed to list the versions of vm %q image %s in %s: %w", vmKey(vm), image, location, err)
+	}
+	var names []string
+	for _, version := range versions {
+		names = append(names, version.Name)
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("vm %q image %s has no versions in %s", vmKey(vm), image, location)
+	}
+	return slices.MaxFunc(names, compareImageVersions), nil
+}
+
+// isUnversionedGalleryImage reports whether an image ID is a compute gallery image definition rather than one of its
+// versions, which Azure resolves to the newest version not excluded from latest.
+func isUnversionedGalleryImage(imageId string) bool {
+	imageId = strings.ToLower(imageId)
+	return strings.Contains(imageId, "/galleries/") && !strings.Contains(imageId, "/versions/")
+}
+
+// resolveGalleryImageVersion returns the ID of the newest version of a VM's compute gallery image that isn't excluded from
+// latest, as Azure would pick it. It fails if the image has no such versions.
+func resolveGalleryImageVersion(ctx *pulumi.Context, endpoint string, vm VM) (string, error) {
+	var versions struct {
+		Value []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				PublishingProfile struct {
+					ExcludeFromLatest bool `json:"excludeFromLatest"`
+				} `json:"publishingProfile"`
+			} `json:"properties"`
+		} `json:"value"`
+	}
+	if err := getResourceManager(ctx, endpoint, vm.Image.Id+"/versions?api-version=2023-07-03", &versions); err != nil {
+		return "", fmt.Errorf("failed to list the versions of vm %q gallery image %q: %w", vmKey(vm), vm.Image.Id, err)
+	}
+	var names []string
+	for _, version := range versions.Value {
+		if !version.Properties.PublishingProfile.ExcludeFromLatest {
+			names = append(names, version.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("vm %q gallery image %q has no versions that aren't excluded from latest", vmKey(vm), vm.Image.Id)
+	}
+	return vm.Image.Id + "/versions/" + slices.MaxFunc(names, compareImageVersions), nil
+}
+
+// compareImageVersions compares two dotted image versions, such as 11.1.4, part by part, numerically where both parts
+// are numbers, so 10.2.0 is newer than 9.1.0.
+func compareImageVersions(a, b string) int {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range min(len(partsA), len(partsB)) {
+		numberA, errA := strconv.Atoi(partsA[i])
+		numberB, errB := strconv.Atoi(partsB[i])
+		if errA != nil || errB != nil {
+			if c := strings.Compare(partsA[i], partsB[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if c := cmp.Compare(numberA, numberB); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(partsA), len(partsB))
+}
+
+// validateHaPair checks that an HA pair names two distinct VMs that exist, share an availability set or proximity placement
+// group, and each have a dataplane NIC, and that its frontend and rules are valid.
+func validateHaPair(haPair HaPair, vms []VM, vnet VNET) error {
+	if len(haPair.VmNames) != 2 || haPair.VmNames[0] == haPair.VmNames[1] {
+		return fmt.Errorf("ha pair %q requires exactly two distinct vmNames", haPair.Name)
+	}
+	var pair []VM
+	for _, vmName := range haPair.VmNames {
+		index := slices.IndexFunc(vms, func(vm VM) bool { return vmKey(vm) == vmName })
+		if index < 0 {
+			return fmt.Errorf("ha pair %q references unknown vm %q", haPair.Name, vmName)
+		}
+		pair = append(pair, vms[index])
+	}
+	shared := func(a, b string) bool { return a != "" && strings.EqualFold(a, b) }
+	if !shared(pair[0].AvailabilitySet.Name, pair[1].AvailabilitySet.Name) &&
+		!shared(pair[0].AvailabilitySetId, pair[1].AvailabilitySetId) &&
+		!shared(pair[0].ProximityPlacementGroupId, pair[1].ProximityPlacementGroupId) {
+		return fmt.Errorf("ha pair %q vms %q and %q must share an availability set or proximity placement group", haPair.Name, haPair.VmNames[0], haPair.VmNames[1])
+	}
+
+	if !containsFold([]string{"nic0", "nic1", "nic2"}, valueOrDefault(haPair.DataplaneNic, "nic1")) {
+		return fmt.Errorf("ha pair %q has unknown dataplaneNic %q, expected nic0, nic1 or nic2", haPair.Name, haPair.DataplaneNic)
+	}
+	dataplaneNics := haPairDataplaneNics(haPair, vms)
+	if len(dataplaneNics) != 2 {
+		return fmt.Errorf("ha pair %q requires both vms to have a nic in slot %s", haPair.Name, valueOrDefault(haPair.DataplaneNic, "nic1"))
+	}
+	for _, nic := range vnet.NIC {
+		if nic.Existing && slices.Contains(dataplaneNics, nic.Name) {
+			return fmt.Errorf("ha pair %q dataplane nic %q is existing, so can't be added to the backend pool", haPair.Name, nic.Name)
+		}
+	}
+
+	switch {
+	case haPair.FrontendPipName != "" && haPair.FrontendSnetName != "":
+		return fmt.Errorf("ha pair %q cannot set both frontendPipName and frontendSnetName", haPair.Name)
+	case haPair.FrontendPipName != "":
+		index := slices.IndexFunc(vnet.PIP, func(pip PIP) bool { return pip.Name == haPair.FrontendPipName })
+		if index < 0 {
+			return fmt.Errorf("ha pair %q references unknown frontend public ip %q", haPair.Name, haPair.FrontendPipName)
+		}
+		if valueOrDefault(vnet.PIP[index].SkuName, "Standard") != "Standard" {
+			return fmt.Errorf("ha pair %q frontend public ip %q must use the Standard sku", haPair.Name, haPair.FrontendPipName)
+		}
+		if haPair.FrontendPrivateIpAddress != "" {
+			return fmt.Errorf("ha pair %q can only set frontendPrivateIpAddress with frontendSnetName", haPair.Name)
+		}
+		for _, rule := range haPair.Rules {
+			if rule.Protocol == "All" {
+				return fmt.Errorf("ha pair %q rule %q uses HA ports, which a public frontend does not support", haPair.Name, rule.Name)
+			}
+		}
+	case haPair.FrontendSnetName != "":
+		if !slices.ContainsFunc(vnet.SNET, func(snet SNET) bool { return snet.Name == haPair.FrontendSnetName }) {
+			return fmt.Errorf("ha pair %q references unknown frontend subnet %q", haPair.Name, haPair.FrontendSnetName)
+		}
+	default:
+		return fmt.Errorf("ha pair %q requires a frontendPipName or frontendSnetName for its shared floating ip", haPair.Name)
+	}
+
+	if len(haPair.Rules) == 0 {
+		return fmt.Errorf("ha pair %q requires at least one rule", haPair.Name)
+	}
+	return validateLoadBalancerRules(haPair.Name, haPair.Probe, haPair.Rules)
+}
+
+// vmSizePattern parses an Azure VM size such as Standard_D8s_v3 into its family, vCPU count, feature letters and version.
+var vmSizePattern = regexp.MustCompile(`^Standard_([A-Z]+)(\d+)(?:-\d+)?([a-z]*)(?:_v(\d+))?`)
+
+// supportsPremiumStorage reports whether a VM size can host Premium SSD disks. These are the "S" families, such as DS and
+// GS, and sizes with the "s" feature letter, such as D8s_v3.
+func supportsPremiumStorage(vmSize string) bool {
+	match := vmSizePattern.FindStringSubmatch(vmSize)
+	if match == nil {
+		return false
+	}
+	family, features := match[1], match[3]
+	return (len(family) > 1 && strings.HasSuffix(family, "S")) || strings.Contains(features, "s")
+}
+
+// supportsUltraSSD reports whether a VM size can host UltraSSD disks. Ultra disks need a premium storage capable size from
+// the D and E v3+, F v2+ or M families.
+func supportsUltraSSD(vmSize string) bool {
+	if !supportsPremiumStorage(vmSize) {
+		return false
+	}
+	match := vmSizePattern.FindStringSubmatch(vmSize)
+	family := match[1]
+	version := 1
+	if match[4] != "" {
+		version, _ = strconv.Atoi(match[4])
+	}
+	switch family {
+	case "D", "E":
+		return version >= 3
+	case "F":
+		return version >= 2
+	case "M":
+		return true
+	}
+	return false
+}
+
+// validateStorage checks the VM's OS and data disk storage account types against the types Azure offers and the VM size.
+func validateStorage(vm VM) error {
+	validateStorageAccountType := func(disk, storageAccountType string) error {
+		switch storageAccountType {
+		case "Standard_LRS", "StandardSSD_LRS", "StandardSSD_ZRS":
+			return nil
+		case "Premium_LRS", "Premium_ZRS", "PremiumV2_LRS":
+			if !supportsPremiumStorage(vm.VmSize) {
+				return fmt.Errorf("vm %q %s uses %s storage, which vm size %q does not support", vmKey(vm), disk, storageAccountType, vm.VmSize)
+			}
+			return nil
+		case "UltraSSD_LRS":
+			if !supportsUltraSSD(vm.VmSize) {
+				return fmt.Errorf("vm %q %s uses %s storage, which vm size %q does not support", vmKey(vm), disk, storageAccountType, vm.VmSize)
+			}
+			return nil
+		}
+		return fmt.Errorf("vm %q %s has unknown storageAccountType %q", vmKey(vm), disk, storageAccountType)
+	}
+
+	switch vm.StorageAccountType {
+	case "UltraSSD_LRS", "PremiumV2_LRS":
+		return fmt.Errorf("vm %q os disk cannot use %s storage", vmKey(vm), vm.StorageAccountType)
+	}
+	if err := validateStorageAccountType("os disk", vm.StorageAccountType); err != nil {
+		return err
+	}
+	for _, disk := range vm.DataDisks {
+		if disk.StorageAccountType == "" {
+			continue
+		}
+		if err := validateStorageAccountType(fmt.Sprintf("data disk %q", disk.Name), disk.StorageAccountType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// supportsTrustedLaunch reports whether a VM size supports Gen2 images and trusted launch. The A and G families, and the
+// original D, DS, F and FS sizes without a version suffix, are Gen1 only.
+func supportsTrustedLaunch(vmSize string) bool {
+	match := vmSizePattern.FindStringSubmatch(vmSize)
+	if match == nil {
+		return false
+	}
+	family, version := match[1], match[4]
+	switch family {
+	case "A", "G", "GS":
+		return false
+	case "D", "DS", "F", "FS":
+		return version != ""
+	}
+	return true
+}
+
+// supportsEncryptionAtHost reports whether a VM size supports encryption at host. Like trusted launch, it is offered on the
+// current generation sizes, but not the A, G and GS families or the original D, DS, F and FS sizes.
+func supportsEncryptionAtHost(vmSize string) bool {
+	return supportsTrustedLaunch(vmSize)
+}
+
+// validateSecurityProfile checks that trusted launch is requested with a Gen2 capable VM size and image, that secure boot
+// and vTPM are only enabled alongside it, and that encryption at host is only enabled on VM sizes that support it.
+func validateSecurityProfile(vm VM) error {
+	if vm.EncryptionAtHost && !supportsEncryptionAtHost(vm.VmSize) {
+		return fmt.Errorf("vm %q enables encryptionAtHost, which vm size %q does not support", vmKey(vm), vm.VmSize)
+	}
+	switch vm.SecurityType {
+	case "":
+		if vm.SecureBootEnabled || vm.VTpmEnabled {
+			return fmt.Errorf("vm %q can only enable secureBoot and vTpm with securityType TrustedLaunch", vmKey(vm))
+		}
+		return nil
+	case "TrustedLaunch":
+	default:
+		return fmt.Errorf("vm %q has unknown securityType %q, expected TrustedLaunch", vmKey(vm), vm.SecurityType)
+	}
+	if !supportsTrustedLaunch(vm.VmSize) {
+		return fmt.Errorf("vm %q uses trusted launch, which vm size %q does not support", vmKey(vm), vm.VmSize)
+	}
+	if vm.Image.HyperVGeneration != "" && vm.Image.HyperVGeneration != "V2" {
+		return fmt.Errorf("vm %q uses trusted launch, which requires a V2 image, but image hyperVGeneration is %q", vmKey(vm), vm.Image.HyperVGeneration)
+	}
+	return nil
+}
+
+// validatePatchSettings checks a VM's patch and assessment modes against the values Azure allows for its OS type. Unset
+// modes keep the image's defaults. AutomaticByPlatform needs the VM agent, which is always provisioned.
+func validatePatchSettings(vm VM) error {
+	patchModes := []string{"", "ImageDefault", "AutomaticByPlatform"}
+	if vm.OsType == "Windows" {
+		patchModes = []string{"", "Manual", "AutomaticByOS", "AutomaticByPlatform"}
+	}
+	if !slices.Contains(patchModes, vm.PatchMode) {
+		return fmt.Errorf("vm %q has unknown patchMode %q, expected one of %s", vmKey(vm), vm.PatchMode, strings.Join(patchModes[1:], ", "))
+	}
+	if !slices.Contains([]string{"", "ImageDefault", "AutomaticByPlatform"}, vm.AssessmentMode) {
+		return fmt.Errorf("vm %q has unknown assessmentMode %q, expected ImageDefault or AutomaticByPlatform", vmKey(vm), vm.AssessmentMode)
+	}
+	return nil
+}
+
+// reservedAdminUsernames lists the admin usernames Azure rejects for VMs.
+var reservedAdminUsernames = []string{
+	"1", "123", "a", "actuser", "adm", "admin", "admin1", "admin2", "administrator", "aspnet", "backup", "console", "david",
+	"guest", "john", "owner", "root", "server", "sql", "support", "support_388945a0", "sys", "test", "test1", "test2", "test3",
+	"user", "user1", "user2", "user3", "user4", "user5",
+}
+
+// linuxAdminUsernamePattern matches the characters Azure allows in Linux admin usernames: letters, digits, hyphens and
+// underscores, not starting with a hyphen or digit.
+var linuxAdminUsernamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// keyVaultSecretIdPattern matches the URI of a Key Vault secret, optionally pinned to a version, capturing the vault's URL.
+var keyVaultSecretIdPattern = regexp.MustCompile(`^(https://[A-Za-z0-9-]{3,24}\.(?:vault\.azure\.net|vault\.azure\.cn|vault\.usgovcloudapi\.net))/secrets/[A-Za-z0-9-]{1,127}(/[0-9a-f]{32})?$`)
+
+// validateAdminPasswordSource checks that a VM's admin password comes from at most one of adminPassword and
+// adminPasswordSecretId, and that a secret ID is a Key Vault secret URI.
+func validateAdminPasswordSource(vm VM) error {
+	if vm.AdminPasswordSecretId == "" {
+		return nil
+	}
+	if vm.AdminPassword != "" {
+		return fmt.Errorf("vm %q sets both adminPassword and adminPasswordSecretId, expected only one", vmKey(vm))
+	}
+	if !keyVaultSecretIdPattern.MatchString(vm.AdminPasswordSecretId) {
+		return fmt.Errorf("vm %q adminPasswordSecretId %q is not a key vault secret uri, expected https://<vault>.vault.azure.net/secrets/<name>[/<version>]", vmKey(vm), vm.AdminPasswordSecretId)
+	}
+	return nil
+}
+
+// readKeyVaultSecret reads the value of a Key Vault secret as a secret output. The azure-native SDK only manages secrets,
+// never returning their values, so the value is read with the Key Vault SDK, using the default Azure credential chain of
+// environment variables, managed identity and the Azure CLI. Previews don't read the vault, so the value is unknown until
+// the update.
+func readKeyVaultSecret(ctx *pulumi.Context, secretId string) (pulumi.StringOutput, error) {
+	match := keyVaultSecretIdPattern.FindStringSubmatch(secretId)
+	if match == nil {
+		return pulumi.StringOutput{}, fmt.Errorf("%q is not a key vault secret uri", secretId)
+	}
+	if ctx.DryRun() {
+		return pulumi.ToSecret(pulumi.UnsafeUnknownOutput(nil)).(pulumi.AnyOutput).AsStringOutput(), nil
+	}
+
+	credential, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return pulumi.StringOutput{}, fmt.Errorf("failed to get credentials to read secret %q: %w", secretId, err)
+	}
+	client, err := azsecrets.NewClient(match[1], credential, nil)
+	if err != nil {
+		return pulumi.StringOutput{}, fmt.Errorf("failed to create a key vault client for secret %q: %w", secretId, err)
+	}
+	id := azsecrets.ID(secretId)
+	response, err := client.GetSecret(ctx.Context(), id.Name(), id.Version(), nil)
+	if err != nil {
+		return pulumi.StringOutput{}, fmt.Errorf("failed to read secret %q: %w", secretId, err)
+	}
+	if response.Value == nil {
+		return pulumi.StringOutput{}, fmt.Errorf("secret %q has no value", secretId)
+	}
+	return pulumi.ToSecret(pulumi.String(*response.Value)).(pulumi.StringOutput), nil
+}
+
+// validateAdminUsername checks a VM's admin username against Azure's rules for its OS type, listing every rule it breaks.
+// Linux usernames are limited to 64 characters, and Windows usernames to 20 characters without special characters.
+func validateAdminUsername(vm VM) error {
+	if vm.OsDiskCreateOption == "Attach" {
+		return nil
+	}
+	if vm.AdminUsername == "" {
+		return fmt.Errorf("vm %q requires adminUsername to be set", vmKey(vm))
+	}
+	var reasons []string
+	if containsFold(reservedAdminUsernames, vm.AdminUsername) {
+		reasons = append(reasons, "it is reserved by Azure")
+	}
+	if vm.OsType == "Windows" {
+		if len(vm.AdminUsername) > 20 {
+			reasons = append(reasons, "it is longer than 20 characters")
+		}
+		if strings.ContainsAny(vm.AdminUsername, `\/"[]:|<>+=;,?*@&`) {
+			reasons = append(reasons, `it contains one of the characters \/"[]:|<>+=;,?*@&`)
+		}
+		if strings.HasSuffix(vm.AdminUsername, ".") {
+			reasons = append(reasons, "it ends with a period")
+		}
+	} else {
+		if len(vm.AdminUsername) > 64 {
+			reasons = append(reasons, "it is longer than 64 characters")
+		}
+		if !linuxAdminUsernamePattern.MatchString(vm.AdminUsername) {
+			reasons = append(reasons, "it must only contain letters, digits, hyphens and underscores, and not start with a hyphen or digit")
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("vm %q adminUsername %q is invalid: %s", vmKey(vm), vm.AdminUsername, strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// imageIdPattern matches managed image, compute gallery image and compute gallery image version resource IDs.
+var imageIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Compute/(images/[^/]+|galleries/[^/]+/images/[^/]+(/versions/[^/]+)?)$`)
+
+// validateImage checks that a VM's image is set either by its marketplace publisher, offer, SKU and version, or by the ID
+// of a managed or compute gallery image, but not both. A VM attaching an existing OS disk instead needs the disk's ID, and
+// no image or settings only applied when provisioning from one.
+func validateImage(vm VM) error {
+	switch vm.OsDiskCreateOption {
+	case "", "FromImage":
+		if vm.OsDiskId != "" {
+			return fmt.Errorf("vm %q can only set osDiskId with osDiskCreateOption Attach", vmKey(vm))
+		}
+	case "Attach":
+		if !managedDiskIdPattern.MatchString(vm.OsDiskId) {
+			return fmt.Errorf("vm %q attaches an os disk, which requires osDiskId to be a managed disk id, got %q", vmKey(vm), vm.OsDiskId)
+		}
+		if vm.Image != (Image{}) {
+			return fmt.Errorf("vm %q attaches an os disk, so cannot set an image", vmKey(vm))
+		}
+		if vm.EphemeralOsDisk || vm.CustomData != "" || vm.CustomDataFile != "" || vm.OsDiskSizeGB != 0 {
+			return fmt.Errorf("vm %q attaches an os disk, so cannot set ephemeralOsDisk, customData, customDataFile or osDiskSizeGB", vmKey(vm))
+		}
+		return nil
+	default:
+		return fmt.Errorf("vm %q has unknown osDiskCreateOption %q, expected FromImage or Attach", vmKey(vm), vm.OsDiskCreateOption)
+	}
+
+	marketplaceFields := []string{vm.Image.Publisher, vm.Image.Offer, vm.Image.Sku, vm.Image.Version}
+	if vm.Image.Id != "" {
+		if slices.ContainsFunc(marketplaceFields, func(field string) bool { return field != "" }) {
+			return fmt.Errorf("vm %q image cannot set both id and publisher, offer, sku or version", vmKey(vm))
+		}
+		if !imageIdPattern.MatchString(vm.Image.Id) {
+			return fmt.Errorf("vm %q has invalid image id %q", vmKey(vm), vm.Image.Id)
+		}
+		return nil
+	}
+	if slices.Contains(marketplaceFields, "") {
+		return fmt.Errorf("vm %q image requires either an id, or all of publisher, offer, sku and version", vmKey(vm))
+	}
+	return nil
+}
+
+// managedDiskIdPattern matches the ID of a managed disk, capturing its resource group and name.
+var managedDiskIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/([^/]+)/providers/Microsoft\.Compute/disks/([^/]+)$`)
+
+// validateOsDiskZone checks that an attached OS disk is in the zone of the VM it boots, or has no zone when the VM has none.
+// A disk created from the image is always placed in the VM's zone, but an existing disk keeps the zone it was created in.
+func validateOsDiskZone(vm VM, diskZones []string) error {
+	if vm.Zone == "" {
+		if len(diskZones) > 0 {
+			return fmt.Errorf("vm %q has no zone, but its os disk %q is in zones %v", vmKey(vm), vm.OsDiskId, diskZones)
+		}
+		return nil
+	}
+	if !slices.Contains(diskZones, vm.Zone) {
+		return fmt.Errorf("vm %q is in zone %q, but its os disk %q is in zones %v", vmKey(vm), vm.Zone, vm.OsDiskId, diskZones)
+	}
+	return nil
+}
+
+// marketplacePublishers lists the image publishers whose offers always need a plan, even when image.plan isn't set, so
+// VM-Series configs written before image.plan keep working. Offers of any other publisher declare their plan with
+// image.plan.
+var marketplacePublishers = []string{"paloaltonetworks"}
+
+// imagePlan returns the marketplace plan of an image, and whether it needs one. A plan set in image.plan takes its unset
+// fields from the image's publisher, offer and SKU, which is also the whole plan of a marketplacePublishers image.
+func imagePlan(image Image) (ImagePlan, bool) {
+	if image.Plan == (ImagePlan{}) && !containsFold(marketplacePublishers, image.Publisher) {
+		return ImagePlan{}, false
+	}
+	return ImagePlan{
+		Name:      valueOrDefault(image.Plan.Name, image.Sku),
+		Product:   valueOrDefault(image.Plan.Product, image.Offer),
+		Publisher: valueOrDefault(image.Plan.Publisher, image.Publisher),
+	}, true
+}
+
+// validatePlan checks that a VM whose image needs a plan has its name, product and publisher, either set in image.plan
+// or taken from the image's SKU, offer and publisher. Gallery and managed images have neither, so set all of image.plan.
+func validatePlan(vm VM) error {
+	plan, required := imagePlan(vm.Image)
+	if !required {
+		return nil
+	}
+	var missing []string
+	if plan.Name == "" {
+		missing = append(missing, "name")
+	}
+	if plan.Product == "" {
+		missing = append(missing, "product")
+	}
+	if plan.Publisher == "" {
+		missing = append(missing, "publisher")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("vm %q image requires a plan, but its plan %s is empty", vmKey(vm), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// marketplaceAgreementKey identifies the agreement accepting the marketplace terms for a plan, and names its resource.
+func marketplaceAgreementKey(plan ImagePlan) string {
+	return strings.ToLower(plan.Publisher + "-" + plan.Product + "-" + plan.Name)
+}
+
+// marketplaceAgreementPlans returns the plans whose marketplace terms need accepting, one per unique publisher, product
+// and name, compared case-insensitively, in the order VMs first use them. Two different plans whose agreement resource
+// names collide are rejected, as they would otherwise share a single agreement.
+func marketplaceAgreementPlans(vms []VM) ([]ImagePlan, error) {
+	var plans []ImagePlan
+	planByName := map[string]ImagePlan{}
+	for _, vm := range vms {
+		vmPlan, required := imagePlan(vm.Image)
+		if !required {
+			continue
+		}
+		name := marketplaceAgreementKey(vmPlan)
+		plan, ok := planByName[name]
+		if !ok {
+			planByName[name] = vmPlan
+			plans = append(plans, vmPlan)
+			continue
+		}
+		if !strings.EqualFold(plan.Publisher, vmPlan.Publisher) || !strings.EqualFold(plan.Product, vmPlan.Product) || !strings.EqualFold(plan.Name, vmPlan.Name) {
+			return nil, fmt.Errorf("vm %q marketplace plan %s/%s/%s shares agreement %q with plan %s/%s/%s", vmKey(vm), vmPlan.Publisher, vmPlan.Product, vmPlan.Name, name, plan.Publisher, plan.Product, plan.Name)
+		}
+	}
+	return plans, nil
+}
+
+// diskNamePattern matches the names Azure allows for managed disks: letters, digits, underscores, periods and hyphens,
+// starting with a letter or digit and ending with a letter, digit or underscore.
+var diskNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+
+// validateDiskName checks a managed disk name against Azure's length and character rules.
+func validateDiskName(name string) error {
+	if len(name) > 80 {
+		return fmt.Errorf("disk name %q is longer than 80 characters", name)
+	}
+	if !diskNamePattern.MatchString(name) {
+		return fmt.Errorf("disk name %q may only contain letters, digits, underscores, periods and hyphens", name)
+	}
+	return nil
+}
+
+// diskEncryptionSetIdPattern loosely matches the resource ID of a disk encryption set.
+var diskEncryptionSetIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Compute/diskEncryptionSets/[^/]+$`)
+
+// diskEncryptionSet returns the disk encryption set parameters for a customer-managed key, or nil to keep platform-managed
+// encryption when id is empty.
+func diskEncryptionSet(id string) compute.DiskEncryptionSetParametersPtrInput {
+	if id == "" {
+		return nil
+	}
+	return &compute.DiskEncryptionSetParametersArgs{
+		Id: pulumi.String(id),
+	}
+}
+
+// supportsHibernation reports whether a VM size can be hibernated. Hibernation is offered on the Dav4, Dasv4 and D and E
+// v5 families with up to 64 GB of memory, and on the Bsv2 family.
+func supportsHibernation(vmSize string) bool {
+	match := vmSizePattern.FindStringSubmatch(vmSize)
+	if match == nil {
+		return false
+	}
+	family, features := match[1], match[3]
+	vCPUs, _ := strconv.Atoi(match[2])
+	version := 1
+	if match[4] != "" {
+		version, _ = strconv.Atoi(match[4])
+	}
+	switch family {
+	case "D":
+		return (version == 5 || (version == 4 && strings.Contains(features, "a"))) && vCPUs <= 16
+	case "E":
+		return version == 5 && vCPUs <= 8
+	case "B":
+		return version == 2 && vCPUs <= 16
+	}
+	return false
+}
+
+// maxDataDisksByVmSize holds the number of data disks each VM size in defaultAcceleratedNetworkingVmSizes can attach, as
+// published by Azure. The count doesn't follow from the size name, as older series such as Dv2 allow more per vCPU.
+var maxDataDisksByVmSize = map[string]int{
+	"Standard_D3_v2":    16,
+	"Standard_D4_v2":    32,
+	"Standard_D5_v2":    64,
+	"Standard_DS3_v2":   16,
+	"Standard_DS4_v2":   32,
+	"Standard_DS5_v2":   64,
+	"Standard_D4_v3":    8,
+	"Standard_D8_v3":    16,
+	"Standard_D16_v3":   32,
+	"Standard_D4s_v3":   8,
+	"Standard_D8s_v3":   16,
+	"Standard_D16s_v3":  32,
+	"Standard_D4_v4":    8,
+	"Standard_D8_v4":    16,
+	"Standard_D16_v4":   32,
+	"Standard_D4s_v4":   8,
+	"Standard_D8s_v4":   16,
+	"Standard_D16s_v4":  32,
+	"Standard_D4s_v5":   8,
+	"Standard_D8s_v5":   16,
+	"Standard_D16s_v5":  32,
+	"Standard_D4ds_v5":  8,
+	"Standard_D8ds_v5":  16,
+	"Standard_D16ds_v5": 32,
+	"Standard_F4s_v2":   8,
+	"Standard_F8s_v2":   16,
+	"Standard_F16s_v2":  32,
+	"Standard_F32s_v2":  32,
+}
+
+// maxDataDisks returns the number of data disks a VM size can attach. Sizes missing from maxDataDisksByVmSize are reported
+// as unknown, leaving the check to Azure.
+func maxDataDisks(vmSize string) (int, bool) {
+	for size, maxDisks := range maxDataDisksByVmSize {
+		if strings.EqualFold(size, vmSize) {
+			return maxDisks, true
+		}
+	}
+	return 0, false
+}
+
+// loggingVolumeDisks expands a logging volume into its data disks, named "<name>0", "<name>1" and so on from startLun. The
+// disks default to no host caching, as recommended for write-heavy striped volumes.
+func loggingVolumeDisks(volume LoggingVolume) ([]DataDisk, error) {
+	if volume.DiskCount < 1 {
+		return nil, fmt.Errorf("logging volume diskCount %d must be at least 1", volume.DiskCount)
+	}
+	if volume.DiskSizeGB < 1 {
+		return nil, fmt.Errorf("logging volume requires diskSizeGB to be set")
+	}
+	if volume.StartLun < 0 {
+		return nil, fmt.Errorf("logging volume has negative startLun %d", volume.StartLun)
+	}
+	var disks []DataDisk
+	for i := range volume.DiskCount {
+		disks = append(disks, DataDisk{
+			Caching:            valueOrDefault(volume.Caching, "None"),
+			DiskSizeGB:         volume.DiskSizeGB,
+			Lun:                volume.StartLun + i,
+			Name:               fmt.Sprintf("%s%d", valueOrDefault(volume.Name, "log"), i),
+			StorageAccountType: volume.StorageAccountType,
+		})
+	}
+	return disks, nil
+}
+
+// supportsEphemeralOsDisk reports whether a VM size has the local storage to hold an ephemeral OS disk in the given
+// placement. Sizes from version 4 on only have local storage with the d feature letter. Older sizes all have a temp disk,
+// but only premium storage capable sizes have a cache. Azure still checks that the OS disk fits when the VM is created.
+func supportsEphemeralOsDisk(vmSize, placement string) bool {
+	match := vmSizePattern.FindStringSubmatch(vmSize)
+	if match == nil {
+		return false
+	}
+	features := match[3]
+	version := 1
+	if match[4] != "" {
+		version, _ = strconv.Atoi(match[4])
+	}
+	if version >= 4 {
+		return strings.Contains(features, "d")
+	}
+	return placement == "ResourceDisk" || supportsPremiumStorage(vmSize)
+}
+
+// validateEphemeralOsDisk checks that an ephemeral OS disk is placed on local storage the VM size has, is deleted with the
+// VM, is read-only cached and isn't encrypted with a disk encryption set, which ephemeral disks don't support.
+func validateEphemeralOsDisk(vm VM) error {
+	if !vm.EphemeralOsDisk {
+		if vm.EphemeralOsDiskPlacement != "" {
+			return fmt.Errorf("vm %q can only set ephemeralOsDiskPlacement with ephemeralOsDisk", vmKey(vm))
+		}
+		return nil
+	}
+	placement := valueOrDefault(vm.EphemeralOsDiskPlacement, "CacheDisk")
+	if placement != "CacheDisk" && placement != "ResourceDisk" {
+		return fmt.Errorf("vm %q has unknown ephemeralOsDiskPlacement %q, expected CacheDisk or ResourceDisk", vmKey(vm), vm.EphemeralOsDiskPlacement)
+	}
+	if !supportsEphemeralOsDisk(vm.VmSize, placement) {
+		return fmt.Errorf("vm %q uses an ephemeral os disk, but vm size %q has no %s to hold it", vmKey(vm), vm.VmSize, strings.ToLower(placement))
+	}
+	if vm.OsDiskDeleteOption != "" && vm.OsDiskDeleteOption != "Delete" {
+		return fmt.Errorf("vm %q uses an ephemeral os disk, which requires osDiskDeleteOption Delete", vmKey(vm))
+	}
+	if vm.OsDiskCaching != "" && vm.OsDiskCaching != "ReadOnly" {
+		return fmt.Errorf("vm %q uses an ephemeral os disk, which requires osDiskCaching ReadOnly", vmKey(vm))
+	}
+	if vm.DiskEncryptionSetId != "" {
+		return fmt.Errorf("vm %q uses an ephemeral os disk, which cannot use diskEncryptionSetId", vmKey(vm))
+	}
+	if vm.HibernationEnabled {
+		return fmt.Errorf("vm %q uses an ephemeral os disk, which does not support hibernation", vmKey(vm))
+	}
+	return nil
+}
+
+// validateHibernation checks that a VM with hibernation enabled uses a supported size, priority and disk types.
+func validateHibernation(vm VM) error {
+	if !vm.HibernationEnabled {
+		return nil
+	}
+	if !supportsHibernation(vm.VmSize) {
+		return fmt.Errorf("vm %q enables hibernation, which vm size %q does not support", vmKey(vm), vm.VmSize)
+	}
+	if vm.Priority == "Spot" || vm.Priority == "Low" {
+		return fmt.Errorf("vm %q cannot enable hibernation with %s priority", vmKey(vm), vm.Priority)
+	}
+	for _, disk := range vm.DataDisks {
+		switch disk.StorageAccountType {
+		case "UltraSSD_LRS", "PremiumV2_LRS":
+			return fmt.Errorf("vm %q cannot enable hibernation with %s data disk %q", vmKey(vm), disk.StorageAccountType, disk.Name)
+		}
+	}
+	return nil
+}
+
+// validateWriteAccelerator checks that a VM enabling write acceleration on its OS disk or data disks is M-series, the only
+// family that supports it, and that those disks use Premium SSD storage.
+func validateWriteAccelerator(vm VM) error {
+	if !vm.OsDiskWriteAcceleratorEnabled && !slices.ContainsFunc(vm.DataDisks, func(disk DataDisk) bool { return disk.WriteAcceleratorEnabled }) {
+		return nil
+	}
+	if match := vmSizePattern.FindStringSubmatch(vm.VmSize); match == nil || match[1] != "M" {
+		return fmt.Errorf("vm %q enables write acceleration, which vm size %q does not support; use an M-series size", vmKey(vm), vm.VmSize)
+	}
+	if vm.OsDiskWriteAcceleratorEnabled && vm.StorageAccountType != "Premium_LRS" {
+		return fmt.Errorf("vm %q enables os disk write acceleration, which requires storageAccountType Premium_LRS", vmKey(vm))
+	}
+	for _, disk := range vm.DataDisks {
+		if disk.WriteAcceleratorEnabled && valueOrDefault(disk.StorageAccountType, vm.StorageAccountType) != "Premium_LRS" {
+			return fmt.Errorf("vm %q data disk %q enables write acceleration, which requires storageAccountType Premium_LRS", vmKey(vm), disk.Name)
+		}
+	}
+	return nil
+}
+
+// valueOrDefault returns value, or fallback when value is empty.
+func valueOrDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// randomizedName returns an explicit Azure name made of the logical name and the shared random suffix. When suffix is nil,
+// it returns nil so the resource is auto-named from its logical name as usual.
+func randomizedName(name string, suffix *random.RandomString) pulumi.StringPtrInput {
+	if suffix == nil {
+		return nil
+	}
+	return pulumi.Sprintf("%s%s", name, suffix.Result)
+}
+
+// explicitName returns the Azure name for a resource that refers to its own child resources by ID, and so can't be
+// auto-named: the logical name and the shared random suffix, or the logical name without its trailing hyphen when suffix
+// is nil.
+func explicitName(name string, suffix *random.RandomString) pulumi.StringOutput {
+	if suffix == nil {
+		return pulumi.String(strings.TrimSuffix(name, "-")).ToStringOutput()
+	}
+	return pulumi.Sprintf("%s%s", name, suffix.Result)
+}
+
+// mergeTags combines the base tags with a resource's extra tags. Extra tags override base tags that share a key.
+func mergeTags(base pulumi.StringMap, extra map[string]string) pulumi.StringMap {
+	tags := pulumi.StringMap{}
+	for key, value := range base {
+		tags[key] = value
+	}
+	for key, value := range extra {
+		tags[key] = pulumi.String(value)
+	}
+	return tags
+}
+
+// withTag adds a tag to resource arguments that have a Tags map, returning them unchanged when they don't. The arguments'
+// own tags are copied rather than modified, as they may be shared with other resources.
+func withTag(props pulumi.Input, key, value string) pulumi.Input {
+	args := reflect.ValueOf(props)
+	if args.Kind() != reflect.Pointer || args.Elem().Kind() != reflect.Struct {
+		return props
+	}
+	field := args.Elem().FieldByName("Tags")
+	if !field.IsValid() || !field.CanSet() || field.Type() != reflect.TypeOf((*pulumi.StringMapInput)(nil)).Elem() {
+		return props
+	}
+	tags := pulumi.StringMap{}
+	if !field.IsNil() {
+		existing, ok := field.Interface().(pulumi.StringMap)
+		if !ok {
+			return props
+		}
+		maps.Copy(tags, existing)
+	}
+	tags[key] = pulumi.String(value)
+	field.Set(reflect.ValueOf(pulumi.StringMapInput(tags)))
+	return props
+}
+
+// stringPtr converts a string to a pulumi.StringPtrInput, returning nil for an empty string so the property is omitted.
+func stringPtr(value string) pulumi.StringPtrInput {
+	if value == "" {
+		return nil
+	}
+	return pulumi.String(value)
+}
+
+// stringArray converts a string slice to a pulumi.StringArray, returning nil for an empty slice so the property is omitted.
+func stringArray(values []string) pulumi.StringArrayInput {
+	if len(values) == 0 {
+		return nil
+	}
+	array := pulumi.StringArray{}
+	for _, value := range values {
+		array = append(array, pulumi.String(value))
+	}
+	return array
+}
+
+// validateDefaultOutboundAccess checks that a subnet disabling default outbound access has another way out, either a NAT
+// Gateway or a route table sending the default route to a virtual appliance such as the firewall.
+func validateDefaultOutboundAccess(snet SNET, vnet VNET) error {
+	if snet.DefaultOutboundAccess == nil || *snet.DefaultOutboundAccess || snet.NatGatewayName != "" {
+		return nil
+	}
+	for _, rt := range vnet.RT {
+		if rt.Name != snet.RTName {
+			continue
+		}
+		for _, route := range rt.Routes {
+			if route.AddressPrefix == "0.0.0.0/0" && route.NextHopType == "VirtualAppliance" {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("subnet %q disables default outbound access, but has neither a nat gateway nor a default route to a virtual appliance", snet.Name)
+}
+
+// virtualNetworkIdPattern matches the resource ID of a virtual network.
+var virtualNetworkIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/virtualNetworks/[^/]+$`)
+
+// virtualNetworkAddressSpaces returns the virtual network's address spaces, whether configured as a single range or a list.
+func virtualNetworkAddressSpaces(vnet VNET) []string {
+	if len(vnet.AddressSpaces) > 0 {
+		return vnet.AddressSpaces
+	}
+	return []string{vnet.AddressSpace}
+}
+
+// validateAddressSpaces checks that the virtual network's address spaces are valid CIDRs that don't overlap, that every
+// subnet address prefix falls within one of them, and that no two subnets overlap. All violations are reported together.
+func validateAddressSpaces(vnet VNET) error {
+	if vnet.AddressSpace != "" && len(vnet.AddressSpaces) > 0 {
+		return fmt.Errorf("vnet sets both addressSpace and addressSpaces")
+	}
+
+	var errs []error
+	var addressSpaces []netip.Prefix
+	for _, addressSpace := range virtualNetworkAddressSpaces(vnet) {
+		prefix, err := netip.ParsePrefix(addressSpace)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vnet address space %q is not a valid cidr: %w", addressSpace, err))
+			continue
+		}
+		for _, other := range addressSpaces {
+			if prefix.Overlaps(other) {
+				errs = append(errs, fmt.Errorf("vnet address space %q overlaps %q", addressSpace, other))
+			}
+		}
+		addressSpaces = append(addressSpaces, prefix.Masked())
+	}
+
+	// Existing subnets aren't managed here, so their address prefixes aren't configured.
+	subnets := slices.DeleteFunc(slices.Clone(vnet.SNET), func(snet SNET) bool { return snet.Existing })
+	for _, snet := range subnets {
+		for _, addressPrefix := range subnetAddressPrefixes(snet) {
+			prefix, err := netip.ParsePrefix(addressPrefix)
+			if err != nil {
+				continue
+			}
+			if !slices.ContainsFunc(addressSpaces, func(space netip.Prefix) bool {
+				return space.Bits() <= prefix.Bits() && space.Contains(prefix.Addr())
+			}) {
+				errs = append(errs, fmt.Errorf("subnet %q address prefix %q is outside the vnet address spaces", snet.Name, addressPrefix))
+			}
+		}
+	}
+
+	for i, snet := range subnets {
+		for _, other := range subnets[i+1:] {
+			for _, addressPrefix := range subnetAddressPrefixes(snet) {
+				for _, otherAddressPrefix := range subnetAddressPrefixes(other) {
+					overlap, err := cidrsOverlap(addressPrefix, otherAddressPrefix)
+					if err != nil {
+						continue
+					}
+					if overlap {
+						errs = append(errs, fmt.Errorf("subnet %q address prefix %q overlaps subnet %q address prefix %q", snet.Name, addressPrefix, other.Name, otherAddressPrefix))
+					}
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// unencryptedSubnetNames lists the subnets reserved for services that can't be deployed into an encrypted virtual network.
+var unencryptedSubnetNames = []string{"AzureFirewallSubnet", "AzureFirewallManagementSubnet"}
+
+// subnetIdPattern, publicIpAddressIdPattern and networkInterfaceIdPattern match the resource IDs of existing subnets, Public
+// IPs and NICs.
+var (
+	subnetIdPattern           = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/virtualNetworks/[^/]+/subnets/[^/]+$`)
+	publicIpAddressIdPattern  = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/publicIPAddresses/[^/]+$`)
+	networkInterfaceIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/networkInterfaces/[^/]+$`)
+)
+
+// loadBalancerFrontendIdPattern matches the ID of a load balancer frontend IP configuration, such as a Gateway Load
+// Balancer's.
+var loadBalancerFrontendIdPattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Network/loadBalancers/[^/]+/frontendIPConfigurations/[^/]+$`)
+
+// validateExisting checks that a resource marked existing has an ID of its type, and that only existing resources set one.
+func validateExisting(kind, name string, existing bool, id string, idPattern *regexp.Regexp) error {
+	if !existing {
+		if id != "" {
+			return fmt.Errorf("%s %q can only set id when existing is set", kind, name)
+		}
+		return nil
+	}
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("%s %q is existing, but has invalid id %q", kind, name, id)
+	}
+	return nil
+}
+
+// validateEncryption checks the virtual network's encryption enforcement, and that none of its subnets host services that
+// don't support encryption: Azure Firewall, Application Gateway and DNS Private Resolver.
+func validateEncryption(vnet VNET) error {
+	if !slices.Contains([]string{"", "AllowUnencrypted", "DropUnencrypted"}, vnet.Encryption.Enforcement) {
+		return fmt.Errorf("vnet has unknown encryption enforcement %q, expected AllowUnencrypted or DropUnencrypted", vnet.Encryption.Enforcement)
+	}
+	if !vnet.Encryption.Enabled {
+		if vnet.Encryption.Enforcement != "" {
+			return fmt.Errorf("vnet can only set encryption enforcement when encryption is enabled")
+		}
+		return nil
+	}
+	if vnet.ApplicationGateway.Name != "" {
+		return fmt.Errorf("vnet encryption does not support application gateway %q", vnet.ApplicationGateway.Name)
+	}
+	for _, snet := range vnet.SNET {
+		if containsFold(unencryptedSubnetNames, snet.Name) {
+			return fmt.Errorf("vnet encryption does not support subnet %q", snet.Name)
+		}
+		if containsFold(snet.Delegations, "Microsoft.Network/dnsResolvers") {
+			return fmt.Errorf("vnet encryption does not support subnet %q, which is delegated to Microsoft.Network/dnsResolvers", snet.Name)
+		}
+	}
+	return nil
+}
+
+// cidrsOverlap reports whether two IPv4 or IPv6 CIDRs share any addresses. CIDRs of different IP versions never overlap.
+func cidrsOverlap(a, b string) (bool, error) {
+	prefixA, err := netip.ParsePrefix(a)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a valid cidr: %w", a, err)
+	}
+	prefixB, err := netip.ParsePrefix(b)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a valid cidr: %w", b, err)
+	}
+	return prefixA.Overlaps(prefixB), nil
+}
+
+// subnetAddressPrefixes returns a subnet's address prefixes, whether configured as a single prefix or a list.
+func subnetAddressPrefixes(snet SNET) []string {
+	if len(snet.AddressPrefixes) > 0 {
+		return snet.AddressPrefixes
+	}
+	return []string{snet.AddressPrefix}
+}
+
+// validateSubnetAddressPrefixes checks that a subnet's address prefixes are valid CIDRs, with at most one IPv4 and one IPv6
+// prefix, and that the singular and list forms are not both set.
+func validateSubnetAddressPrefixes(snet SNET) error {
+	if snet.AddressPrefix != "" && len(snet.AddressPrefixes) > 0 {
+		return fmt.Errorf("subnet %q sets both addressPrefix and addressPrefixes", snet.Name)
+	}
+	ipv4Count, ipv6Count := 0, 0
+	for _, addressPrefix := range subnetAddressPrefixes(snet) {
+		prefix, err := netip.ParsePrefix(addressPrefix)
+		if err != nil {
+			return fmt.Errorf("subnet %q address prefix %q is not a valid cidr: %w", snet.Name, addressPrefix, err)
+		}
+		if prefix.Addr().Is4() {
+			ipv4Count++
+		} else {
+			ipv6Count++
+		}
+	}
+	if ipv4Count > 1 || ipv6Count > 1 {
+		return fmt.Errorf("subnet %q supports at most one ipv4 and one ipv6 address prefix", snet.Name)
+	}
+	return nil
+}
+
+// validateRoute checks a route's address prefix and next hop type, and that a next hop IP address is given only, and always,
+// for virtual appliance routes. Both may be IPv4 or IPv6, but a virtual appliance next hop must be in the prefix's family.
+func validateRoute(rt RT, route Route) error {
+	prefix, err := netip.ParsePrefix(route.AddressPrefix)
+	if err != nil {
+		return fmt.Errorf("route table %q route %q has invalid addressPrefix %q: %w", rt.Name, route.Name, route.AddressPrefix, err)
+	}
+	switch route.NextHopType {
+	case "VirtualAppliance":
+		nextHop, err := netip.ParseAddr(route.NextHopIpAddress)
+		if err != nil {
+			return fmt.Errorf("route table %q route %q requires a valid nextHopIpAddress for the VirtualAppliance next hop type: %w", rt.Name, route.Name, err)
+		}
+		if nextHop.Is4() != prefix.Addr().Is4() {
+			return fmt.Errorf("route table %q route %q addressPrefix %q is %s but nextHopIpAddress %q is %s", rt.Name, route.Name, route.AddressPrefix, addressFamily(prefix.Addr()), route.NextHopIpAddress, addressFamily(nextHop))
+		}
+	case "VnetLocal", "Internet", "VirtualNetworkGateway", "None":
+		if route.NextHopIpAddress != "" {
+			return fmt.Errorf("route table %q route %q can only set nextHopIpAddress for the VirtualAppliance next hop type", rt.Name, route.Name)
+		}
+	default:
+		return fmt.Errorf("route table %q route %q has unknown nextHopType %q, expected VirtualAppliance, VnetLocal, Internet, VirtualNetworkGateway or None", rt.Name, route.Name, route.NextHopType)
+	}
+	return nil
+}
+
+// addressFamily names the address family of addr, for error messages.
+func addressFamily(addr netip.Addr) string {
+	if addr.Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// validateConfigSchema decodes each structured config key into its config struct, then logs a warning for each key of the
+// raw config that is missing once the struct is encoded back, as that key was dropped. Keys are matched case-insensitively,
+// like the decoder does.
+func validateConfigSchema(ctx *pulumi.Context, cfg *config.Config) error {
+	schemas := []struct {
+		key   string
+		value any
+	}{
+		{"bootstrap", &Bootstrap{}},
+		{"customTimeouts", &CustomTimeouts{}},
+		{"defaultRules", &[]Rule{}},
+		{"diagnosticSettings", &DiagnosticSettings{}},
+		{"dnsZone", &DnsZone{}},
+		{"haPair", &HaPair{}},
+		{"resourceGroup", &ResourceGroup{}},
+		{"tags", &Tags{}},
+		{"vm", &VM{}},
+		{"vms", &[]VM{}},
+		{"vnet", &VNET{}},
+	}
+	for _, schema := range schemas {
+		raw := cfg.Get(schema.key)
+		if raw == "" {
+			continue
+		}
+		var rawValue any
+		if err := json.Unmarshal([]byte(raw), &rawValue); err != nil {
+			return fmt.Errorf("failed to read %s: %w", schema.key, err)
+		}
+		if err := json.Unmarshal([]byte(raw), schema.value); err != nil {
+			return fmt.Errorf("failed to read %s: %w", schema.key, err)
+		}
+		data, err := json.Marshal(schema.value)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", schema.key, err)
+		}
+		var knownValue any
+		if err := json.Unmarshal(data, &knownValue); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", schema.key, err)
+		}
+		for _, key := range unknownConfigKeys(schema.key, rawValue, knownValue) {
+			ctx.Log.Warn(fmt.Sprintf("config key %q is not a known setting and is ignored; check its spelling and nesting", key), nil)
+		}
+	}
+	return nil
+}
+
+// unknownConfigKeys returns the dotted paths of the keys in raw that have no case-insensitive match in known, recursing
+// into matching objects and into list items by index.
+func unknownConfigKeys(path string, raw, known any) []string {
+	var unknown []string
+	switch raw := raw.(type) {
+	case map[string]any:
+		knownMap, _ := known.(map[string]any)
+		for _, key := range slices.Sorted(maps.Keys(raw)) {
+			matched := false
+			for knownKey, knownValue := range knownMap {
+				if strings.EqualFold(key, knownKey) {
+					unknown = append(unknown, unknownConfigKeys(path+"."+key, raw[key], knownValue)...)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				unknown = append(unknown, path+"."+key)
+			}
+		}
+	case []any:
+		knownList, _ := known.([]any)
+		for i := range min(len(raw), len(knownList)) {
+			unknown = append(unknown, unknownConfigKeys(fmt.Sprintf("%s[%d]", path, i), raw[i], knownList[i])...)
+		}
+	}
+	return unknown
+}
+
+// expandVmCounts replaces each VM with a count by that many instances, named "<name>-<index>". Each instance uses the NICs
+// of its NIC map suffixed with its index. When such a NIC isn't configured, it is cloned from the unsuffixed NIC, which is
+// then only a template and isn't created itself. Cloned NICs get dynamic private IPs, and their Public IPs are cloned the
+// same way, with the DNS label suffixed too.
+func expandVmCounts(vnet VNET, vms []VM) (VNET, []VM, error) {
+	if !slices.ContainsFunc(vms, func(vm VM) bool { return vm.Count != 0 }) {
+		return vnet, vms, nil
+	}
+	vnet.NIC = slices.Clone(vnet.NIC)
+	vnet.PIP = slices.Clone(vnet.PIP)
+	nicTemplates := make(map[string]bool)
+	pipTemplates := make(map[string]bool)
+	indexed := func(name string, index int) string { return fmt.Sprintf("%s-%d", name, index) }
+
+	clonePip := func(pipName string, index int) string {
+		if pipName == "" {
+			return ""
+		}
+		if slices.ContainsFunc(vnet.PIP, func(pip PIP) bool { return pip.Name == indexed(pipName, index) }) {
+			return indexed(pipName, index)
+		}
+		template := slices.IndexFunc(vnet.PIP, func(pip PIP) bool { return pip.Name == pipName })
+		if template < 0 || vnet.PIP[template].Existing {
+			return indexed(pipName, index)
+		}
+		pip := vnet.PIP[template]
+		pip.Name = indexed(pipName, index)
+		if pip.DomainNameLabel != "" {
+			pip.DomainNameLabel = indexed(pip.DomainNameLabel, index)
+		}
+		pip.ReverseFqdn = ""
+		vnet.PIP = append(vnet.PIP, pip)
+		pipTemplates[pipName] = true
+		return pip.Name
+	}
+
+	var expanded []VM
+	for _, vm := range vms {
+		if vm.Count == 0 {
+			expanded = append(expanded, vm)
+			continue
+		}
+		if vm.Count < 0 {
+			return vnet, nil, fmt.Errorf("vm %q count %d must not be negative", vmKey(vm), vm.Count)
+		}
+		if vm.Name == "" {
+			return vnet, nil, fmt.Errorf("vm with count %d requires a name to index its instances by", vm.Count)
+		}
+		for index := range vm.Count {
+			instance := vm
+			instance.Count = 0
+			instance.DataDisks = slices.Clone(vm.DataDisks)
+			instance.Name = indexed(vm.Name, index)
+			if vm.ComputerName != "" {
+				instance.ComputerName = indexed(vm.ComputerName, index)
+			}
+			for _, slot := range []*string{&instance.NicMap.Nic0, &instance.NicMap.Nic1, &instance.NicMap.Nic2} {
+				if *slot == "" {
+					continue
+				}
+				nicName := indexed(*slot, index)
+				if !slices.ContainsFunc(vnet.NIC, func(nic NIC) bool { return nic.Name == nicName }) {
+					template := slices.IndexFunc(vnet.NIC, func(nic NIC) bool { return nic.Name == *slot })
+					if template < 0 {
+						return vnet, nil, fmt.Errorf("vm %q requires nic %q, or a nic %q to clone it from", instance.Name, nicName, *slot)
+					}
+					nic := vnet.NIC[template]
+					if nic.Existing {
+						return vnet, nil, fmt.Errorf("vm %q can't clone nic %q, as it is existing", instance.Name, *slot)
+					}
+					nic.Name = nicName
+					nic.PrivateIpAddress = ""
+					nic.PipName = clonePip(nic.PipName, index)
+					nic.IpConfigurations = slices.Clone(nic.IpConfigurations)
+					for i := range nic.IpConfigurations {
+						nic.IpConfigurations[i].PrivateIpAddress = ""
+						nic.IpConfigurations[i].PipName = clonePip(nic.IpConfigurations[i].PipName, index)
+					}
+					vnet.NIC = append(vnet.NIC, nic)
+					nicTemplates[*slot] = true
+				}
+				*slot = nicName
+			}
+			expanded = append(expanded, instance)
+		}
+	}
+
+	vnet.NIC = slices.DeleteFunc(vnet.NIC, func(nic NIC) bool { return nicTemplates[nic.Name] })
+	vnet.PIP = slices.DeleteFunc(vnet.PIP, func(pip PIP) bool { return pipTemplates[pip.Name] })
+	return vnet, expanded, nil
+}
+
+// environmentPresets holds the defaults applied for each environment. The test environment keeps the built-in defaults.
+var environmentPresets = map[string]EnvironmentPreset{
+	"dev": {
+		EvictionPolicy: "Deallocate",
+		OsDiskSizeGB:   64,
+		Priority:       "Spot",
+	},
+	"prod": {
+		ProtectResources: true,
+		Zone:             "1",
+	},
+	"test": {},
+}
+
+// applyEnvironmentPreset overlays an environment preset onto a VM, only filling in settings the VM leaves unset. Presets
+// are skipped where they would conflict with the VM's own settings: zones with availability sets, Spot with hibernation,
+// and smaller OS disks with Windows images, which need 127 GB.
+func applyEnvironmentPreset(vm VM, preset EnvironmentPreset) VM {
+	if vm.Zone == "" && vm.AvailabilitySet.Name == "" && vm.AvailabilitySetId == "" {
+		vm.Zone = preset.Zone
+	}
+	if vm.Priority == "" && !vm.HibernationEnabled {
+		vm.Priority = preset.Priority
+		if vm.Priority != "" && vm.EvictionPolicy == "" {
+			vm.EvictionPolicy = preset.EvictionPolicy
+		}
+	}
+	if vm.OsDiskSizeGB == 0 && vm.OsType != "Windows" {
+		vm.OsDiskSizeGB = preset.OsDiskSizeGB
+	}
+	return vm
+}
+
+// summarizeResources counts the NSGs, route tables, subnets, Public IPs, NICs and VMs the configuration creates. Existing
+// subnets, Public IPs and NICs are only read, so aren't counted.
+func summarizeResources(vnet VNET, vms []VM) ResourceCounts {
+	counts := ResourceCounts{
+		NSGs:        len(vnet.NSG),
+		RouteTables: len(vnet.RT),
+		VMs:         len(vms),
+	}
+	for _, nic := range vnet.NIC {
+		if !nic.Existing {
+			counts.NICs++
+		}
+	}
+	for _, pip := range vnet.PIP {
+		if !pip.Existing {
+			counts.PublicIPs++
+		}
+	}
+	for _, snet := range vnet.SNET {
+		if !snet.Existing {
+			counts.Subnets++
+		}
+	}
+	return counts
+}
+
+// readConfigFile reads the tags, vnet and vm or vms settings from a JSON or YAML file, picked by its extension. YAML is
+// converted to JSON first, so keys match fields case-insensitively in both formats, as they do in Pulumi configuration.
+func readConfigFile(path string) (ConfigFile, error) {
+	var configFile ConfigFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return configFile, fmt.Errorf("failed to read config file %q: %w", path, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		var value interface{}
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return configFile, fmt.Errorf("failed to parse config file %q: %w", path, err)
+		}
+		data, err = json.Marshal(value)
+		if err != nil {
+			return configFile, fmt.Errorf("failed to convert config file %q to json: %w", path, err)
+		}
+	default:
+		return configFile, fmt.Errorf("config file %q must have a .json, .yaml or .yml extension", path)
+	}
+
+	if err := json.Unmarshal(data, &configFile); err != nil {
+		return configFile, fmt.Errorf("failed to parse config file %q: %w", path, err)
+	}
+	return configFile, nil
+}
+
+// nicMapNames returns the names of the NICs in a NIC map, in order, skipping the blank ones.
+func nicMapNames(m NICMAP) []string {
+	var names []string
+	for _, name := range []string{m.Nic0, m.Nic1, m.Nic2} {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// buildNetworkInterfaceReferences builds a VM's NIC references from its NIC map. Blank NICs are skipped, and the first NIC
+// given is the primary one.
+func buildNetworkInterfaceReferences(m NICMAP, nicMap map[string]*network.NetworkInterface) (compute.NetworkInterfaceReferenceArray, error) {
+	var references compute.NetworkInterfaceReferenceArray
+	for i, name := range nicMapNames(m) {
+		nic, exists := nicMap[name]
+		if !exists {
+			return nil, fmt.Errorf("nic map references unknown nic %q", name)
+		}
+		references = append(references, compute.NetworkInterfaceReferenceArgs{
+			Id:      nic.ID(),
+			Primary: pulumi.Bool(i == 0),
+		})
+	}
+	if len(references) == 0 {
+		return nil, fmt.Errorf("nic map must reference at least one nic")
+	}
+	return references, nil
+}
+
+// validateZones checks that every Public IP attached to one of the VM's NICs is deployable alongside a zonal VM.
+// A zonal Public IP must be pinned to the VM's zone, or be zone-redundant across a set that includes it.
+func validateZones(vm VM, vnet VNET) error {
+	if vm.Zone == "" {
+		return nil
+	}
+
+	pipZones := make(map[string][]string)
+	for _, pip := range vnet.PIP {
+		pipZones[pip.Name] = publicIpZones(pip)
+	}
+
+	for _, nicName := range nicMapNames(vm.NicMap) {
+		for _, nic := range vnet.NIC {
+			if nic.Name != nicName {
+				continue
+			}
+			for _, ipConfig := range nic.IpConfigurations {
+				zones, exists := pipZones[ipConfig.PipName]
+				if !exists || len(zones) == 0 {
+					continue
+				}
+				if !slices.Contains(zones, vm.Zone) {
+					return fmt.Errorf("public ip %q is in zones %v but is attached to nic %q on a vm in zone %q", ipConfig.PipName, zones, nic.Name, vm.Zone)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// vmDiskNameSuffix returns the suffix of a VM's disk names. Named VMs include their name so disks stay unique across VMs.
+func vmDiskNameSuffix(vm VM, nameSuffix string) string {
+	if vm.Name != "" {
+		return vm.Name + "-" + nameSuffix
+	}
+	return nameSuffix
+}
+
+// validateDisks checks that a VM's OS disk size is within Azure's 30-4095 GB range, once defaulted to 127 GB, and that its
+// OS and data disks have known caching types and delete options. Data disk LUNs must be unique and non-negative.
+func validateDisks(vm VM) error {
+	if osDiskSizeGB := cmp.Or(vm.OsDiskSizeGB, 127); osDiskSizeGB < 30 || osDiskSizeGB > 4095 {
+		return fmt.Errorf("vm %q osDiskSizeGB %d is outside the allowed range of 30-4095", vmKey(vm), osDiskSizeGB)
+	}
+	if vm.OsDiskCaching != "" {
+		if _, err := cachingType(vm.OsDiskCaching); err != nil {
+			return fmt.Errorf("vm %q osDiskCaching: %w", vmKey(vm), err)
+		}
+	}
+	if _, err := deleteOption(vm.OsDiskDeleteOption); err != nil {
+		return fmt.Errorf("vm %q osDiskDeleteOption: %w", vmKey(vm), err)
+	}
+	usedLuns := make(map[int]string)
+	for _, disk := range vm.DataDisks {
+		if disk.Lun < 0 {
+			return fmt.Errorf("vm %q data disk %q has negative lun %d", vmKey(vm), disk.Name, disk.Lun)
+		}
+		if existing, exists := usedLuns[disk.Lun]; exists {
+			return fmt.Errorf("vm %q data disks %q and %q share lun %d", vmKey(vm), existing, disk.Name, disk.Lun)
+		}
+		usedLuns[disk.Lun] = disk.Name
+		if disk.Caching != "" {
+			if _, err := cachingType(disk.Caching); err != nil {
+				return fmt.Errorf("vm %q data disk %q: %w", vmKey(vm), disk.Name, err)
+			}
+		}
+		if _, err := deleteOption(disk.DeleteOption); err != nil {
+			return fmt.Errorf("vm %q data disk %q deleteOption: %w", vmKey(vm), disk.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateIdentity checks that a VM's managed identity type is known, and that user-assigned identities are listed exactly
+// when the type includes UserAssigned.
+func validateIdentity(vm VM) error {
+	switch compute.ResourceIdentityType(vm.Identity.Type) {
+	case "":
+	case compute.ResourceIdentityTypeSystemAssigned:
+		if len(vm.Identity.UserAssignedIdentities) > 0 {
+			return fmt.Errorf("vm %q identity type %q does not accept userAssignedIdentities", vmKey(vm), vm.Identity.Type)
+		}
+	case compute.ResourceIdentityTypeUserAssigned, compute.ResourceIdentityType_SystemAssigned_UserAssigned:
+		if len(vm.Identity.UserAssignedIdentities) == 0 {
+			return fmt.Errorf("vm %q identity type %q requires userAssignedIdentities to be set", vmKey(vm), vm.Identity.Type)
+		}
+	default:
+		return fmt.Errorf("vm %q has unknown identity type %q", vmKey(vm), vm.Identity.Type)
+	}
+	return nil
+}
+
+// cachingType maps a caching string from configuration to a known compute.CachingTypes value.
+func cachingType(caching string) (compute.CachingTypes, error) {
+	switch compute.CachingTypes(caching) {
+	case compute.CachingTypesNone, compute.CachingTypesReadOnly, compute.CachingTypesReadWrite:
+		return compute.CachingTypes(caching), nil
+	}
+	return "", fmt.Errorf("unknown caching type %q", caching)
+}
+
+// securityRuleArgs builds the arguments for a security rule. Each address prefix and port range is passed through in either
+// its singular or plural form, and a source or destination can instead name application security groups, which are
+// resolved to their IDs. The rule must already have passed validateSecurityRules.
+func securityRuleArgs(rule Rule, asgMap map[string]*network.ApplicationSecurityGroup) network.SecurityRuleTypeArgs {
+	args := network.SecurityRuleTypeArgs{
+		Access:      pulumi.String(rule.Access),
+		Description: stringPtr(rule.Description),
+		Direction:   pulumi.String(rule.Direction),
+		Name:        pulumi.String(rule.Name),
+		Priority:    pulumi.Int(rule.Priority),
+		Protocol:    pulumi.String(rule.Protocol),
+	}
+	applicationSecurityGroups := func(names []string) network.ApplicationSecurityGroupTypeArray {
+		var groups network.ApplicationSecurityGroupTypeArray
+		for _, name := range names {
+			groups = append(groups, network.ApplicationSecurityGroupTypeArgs{Id: asgMap[name].ID()})
+		}
+		return groups
+	}
+
+	switch {
+	case len(rule.DestinationAddressPrefixes) > 0:
+		args.DestinationAddressPrefixes = stringArray(rule.DestinationAddressPrefixes)
+	case len(rule.DestinationApplicationSecurityGroups) > 0:
+		args.DestinationApplicationSecurityGroups = applicationSecurityGroups(rule.DestinationApplicationSecurityGroups)
+	default:
+		args.DestinationAddressPrefix = pulumi.String(rule.DestinationAddressPrefix)
+	}
+	if len(rule.DestinationPortRanges) > 0 {
+		args.DestinationPortRanges = stringArray(rule.DestinationPortRanges)
+	} else {
+		args.DestinationPortRange = pulumi.String(rule.DestinationPortRange)
+	}
+	switch {
+	case len(rule.SourceAddressPrefixes) > 0:
+		args.SourceAddressPrefixes = stringArray(rule.SourceAddressPrefixes)
+	case len(rule.SourceApplicationSecurityGroups) > 0:
+		args.SourceApplicationSecurityGroups = applicationSecurityGroups(rule.SourceApplicationSecurityGroups)
+	default:
+		args.SourceAddressPrefix = pulumi.String(rule.SourceAddressPrefix)
+	}
+	if len(rule.SourcePortRanges) > 0 {
+		args.SourcePortRanges = stringArray(rule.SourcePortRanges)
+	} else {
+		args.SourcePortRange = pulumi.String(rule.SourcePortRange)
+	}
+	return args
+}
+
+// validateSecurityRules checks every rule in the NSG, including its default rules, for a unique name, an in-range priority
+// that is unique within its direction, known access, direction and protocol values, and a description of at most 140
+// characters. Each address prefix and port range must be set in only its singular or plural form, as Azure rejects rules
+// that set both, and application security groups must exist and can't be combined with an address prefix. All
+// violations are reported together.
+func validateSecurityRules(nsg NSG, asgs []ASG) error {
+	var errs []error
+	priorities := make(map[string]string)
+	names := make(map[string]bool)
+	for _, rule := range nsg.Rules {
+		if rule.DestinationAddressPrefix != "" && len(rule.DestinationAddressPrefixes) > 0 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q sets both destinationAddressPrefix and destinationAddressPrefixes", nsg.Name, rule.Name))
+		}
+		if rule.DestinationPortRange != "" && len(rule.DestinationPortRanges) > 0 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q sets both destinationPortRange and destinationPortRanges", nsg.Name, rule.Name))
+		}
+		if rule.SourceAddressPrefix != "" && len(rule.SourceAddressPrefixes) > 0 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q sets both sourceAddressPrefix and sourceAddressPrefixes", nsg.Name, rule.Name))
+		}
+		if rule.SourcePortRange != "" && len(rule.SourcePortRanges) > 0 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q sets both sourcePortRange and sourcePortRanges", nsg.Name, rule.Name))
+		}
+		if (rule.DestinationAddressPrefix != "" || len(rule.DestinationAddressPrefixes) > 0) && len(rule.DestinationApplicationSecurityGroups) > 0 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q sets both a destination address prefix and destinationApplicationSecurityGroups", nsg.Name, rule.Name))
+		}
+		if (rule.SourceAddressPrefix != "" || len(rule.SourceAddressPrefixes) > 0) && len(rule.SourceApplicationSecurityGroups) > 0 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q sets both a source address prefix and sourceApplicationSecurityGroups", nsg.Name, rule.Name))
+		}
+		for _, asgName := range slices.Concat(rule.DestinationApplicationSecurityGroups, rule.SourceApplicationSecurityGroups) {
+			if !slices.ContainsFunc(asgs, func(asg ASG) bool { return asg.Name == asgName }) {
+				errs = append(errs, fmt.Errorf("nsg %q rule %q references unknown application security group %q", nsg.Name, rule.Name, asgName))
+			}
+		}
+
+		if names[rule.Name] {
+			errs = append(errs, fmt.Errorf("nsg %q has more than one rule named %q", nsg.Name, rule.Name))
+		}
+		names[rule.Name] = true
+		if rule.Priority < 100 || rule.Priority > 4096 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q priority %d must be between 100 and 4096", nsg.Name, rule.Name, rule.Priority))
+		}
+		key := fmt.Sprintf("%s/%d", strings.ToLower(rule.Direction), rule.Priority)
+		if other, exists := priorities[key]; exists {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q priority %d is already used by rule %q", nsg.Name, rule.Name, rule.Priority, other))
+		} else {
+			priorities[key] = rule.Name
+		}
+		if !containsFold([]string{"Allow", "Deny"}, rule.Access) {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q has unknown access %q, expected Allow or Deny", nsg.Name, rule.Name, rule.Access))
+		}
+		if !containsFold([]string{"Inbound", "Outbound"}, rule.Direction) {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q has unknown direction %q, expected Inbound or Outbound", nsg.Name, rule.Name, rule.Direction))
+		}
+		if !containsFold([]string{"*", "Ah", "Esp", "Icmp", "Tcp", "Udp"}, rule.Protocol) {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q has unknown protocol %q, expected *, Ah, Esp, Icmp, Tcp or Udp", nsg.Name, rule.Name, rule.Protocol))
+		}
+		if len(rule.Description) > 140 {
+			errs = append(errs, fmt.Errorf("nsg %q rule %q description exceeds the 140 character limit", nsg.Name, rule.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// containsFold reports whether values contains value, ignoring case.
+func containsFold(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(v, value) })
+}
+
+// auditDestructiveChanges lists the configured resources whose data is lost on "pulumi destroy": Public IPs, whose addresses
+// are released, and VMs along with their OS disks, and data disks, that are deleted with them. Disks set to Detach survive
+// the VM, and protected VMs block the destroy. Existing resources are only read, so are never destroyed.
+func auditDestructiveChanges(vnet VNET, vms []VM, protectResources bool) []string {
+	changes := []string{}
+	for _, pip := range vnet.PIP {
+		if !pip.Existing {
+			changes = append(changes, fmt.Sprintf("public ip %q is deleted and its address released", pip.Name))
+		}
+	}
+	if protectResources {
+		return changes
+	}
+	for _, vm := range vms {
+		changes = append(changes, fmt.Sprintf("vm %q is deleted", vmKey(vm)))
+		switch {
+		case vm.EphemeralOsDisk:
+			changes = append(changes, fmt.Sprintf("vm %q ephemeral os disk is deleted", vmKey(vm)))
+		case valueOrDefault(vm.OsDiskDeleteOption, "Delete") == "Delete":
+			changes = append(changes, fmt.Sprintf("vm %q os disk is deleted", vmKey(vm)))
+		}
+		for _, disk := range vm.DataDisks {
+			if valueOrDefault(disk.DeleteOption, "Delete") == "Delete" {
+				changes = append(changes, fmt.Sprintf("vm %q data disk %q is deleted", vmKey(vm), disk.Name))
+			}
+		}
+	}
+	return changes
+}
+
+// buildTopologyDot describes the virtual network, subnets, NSGs, route tables, NAT gateways, Public IPs, NICs, load
+// balancer and VMs as a Graphviz dot graph. It only reads the configuration, so the names are the configured ones.
+func buildTopologyDot(vnet VNET, vms []VM) string {
+	var b strings.Builder
+	node := func(id, label, shape string) {
+		fmt.Fprintf(&b, "  %q [label=%q, shape=%s];\n", id, label, shape)
+	}
+	edge := func(from, to string) {
+		fmt.Fprintf(&b, "  %q -> %q;\n", from, to)
+	}
+
+	b.WriteString("digraph topology {\n")
+	node("vnet", "vnet\n"+strings.Join(virtualNetworkAddressSpaces(vnet), "\n"), "box3d")
+	for _, nsg := range vnet.NSG {
+		node("nsg/"+nsg.Name, "nsg "+nsg.Name, "octagon")
+	}
+	for _, rt := range vnet.RT {
+		node("rt/"+rt.Name, "rt "+rt.Name, "note")
+	}
+	for _, pip := range vnet.PIP {
+		node("pip/"+pip.Name, "pip "+pip.Name, "ellipse")
+	}
+	for _, natGateway := range vnet.NATGW {
+		node("ng/"+natGateway.Name, "ng "+natGateway.Name, "house")
+		edge("ng/"+natGateway.Name, "pip/"+natGateway.PipName)
+	}
+	for _, snet := range vnet.SNET {
+		node("snet/"+snet.Name, "snet "+snet.Name+"\n"+strings.Join(subnetAddressPrefixes(snet), "\n"), "box")
+		edge("vnet", "snet/"+snet.Name)
+		if snet.NSGName != "" {
+			edge("snet/"+snet.Name, "nsg/"+snet.NSGName)
+		}
+		if snet.RTName != "" {
+			edge("snet/"+snet.Name, "rt/"+snet.RTName)
+		}
+		if snet.NatGatewayName != "" {
+			edge("snet/"+snet.Name, "ng/"+snet.NatGatewayName)
+		}
+	}
+	for _, nic := range vnet.NIC {
+		node("nic/"+nic.Name, "nic "+nic.Name, "component")
+		for _, ipConfig := range nic.IpConfigurations {
+			edge("nic/"+nic.Name, "snet/"+ipConfig.SnetName)
+			if ipConfig.PipName != "" {
+				edge("nic/"+nic.Name, "pip/"+ipConfig.PipName)
+			}
+		}
+	}
+	if vnet.LoadBalancer.Name != "" {
+		node("lb/"+vnet.LoadBalancer.Name, "lb "+vnet.LoadBalancer.Name, "diamond")
+		edge("lb/"+vnet.LoadBalancer.Name, "snet/"+vnet.LoadBalancer.FrontendSnetName)
+		for _, nicName := range vnet.LoadBalancer.BackendNics {
+			edge("lb/"+vnet.LoadBalancer.Name, "nic/"+nicName)
+		}
+	}
+	for _, vm := range vms {
+		node("vm/"+vmKey(vm), "vm "+vmKey(vm), "box")
+		for _, nicName := range nicMapNames(vm.NicMap) {
+			edge("vm/"+vmKey(vm), "nic/"+nicName)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
@@ -0,0 +1,1381 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi-azure-native-sdk/compute/v2"
+	"github.com/pulumi/pulumi-azure-native-sdk/network/v2"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// mocks stands in for the Pulumi engine and Azure, giving each resource an ID derived from its logical name and echoing
+// its inputs back as its outputs.
+type mocks struct{}
+
+func (mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	return args.Name + "_id", args.Inputs, nil
+}
+
+func (mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	return args.Args, nil
+}
+
+// recordingMocks is a mocks that also records every resource registered, keyed by its type token and logical name.
+type recordingMocks struct {
+	mocks
+	mu        sync.Mutex
+	resources map[string]pulumi.MockResourceArgs
+}
+
+func (m *recordingMocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.resources == nil {
+		m.resources = make(map[string]pulumi.MockResourceArgs)
+	}
+	m.resources[args.TypeToken+"::"+args.Name] = args
+	return m.mocks.NewResource(args)
+}
+
+// byType returns the recorded resources of a type, keyed by logical name.
+func (m *recordingMocks) byType(typeToken string) map[string]pulumi.MockResourceArgs {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resources := make(map[string]pulumi.MockResourceArgs)
+	for _, args := range m.resources {
+		if args.TypeToken == typeToken {
+			resources[args.Name] = args
+		}
+	}
+	return resources
+}
+
+// runApply builds a plan from cfg and applies it against mocks, returning the resources it registered.
+func runApply(t *testing.T, cfg Config) *recordingMocks {
+	t.Helper()
+	plan, err := buildPlan(cfg)
+	if err != nil {
+		t.Fatalf("buildPlan() error = %v", err)
+	}
+	m := &recordingMocks{}
+	if err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		return apply(ctx, plan)
+	}, pulumi.WithMocks("project", "test", m)); err != nil {
+		t.Fatalf("apply() error = %v", err)
+	}
+	return m
+}
+
+// testConfig returns a minimal valid configuration: one VM with one NIC in one subnet, as main would read it.
+func testConfig() Config {
+	return Config{
+		DefaultRulesPriorityBase: 100,
+		DeployVM:                 true,
+		InheritResourceGroupTags: true,
+		OsDiskIdLength:           8,
+		Stack:                    "test",
+		Tags: Tags{
+			Automation: "pulumi",
+			Solution:   "panos",
+		},
+		VMs: []VM{{
+			AdminPassword: "Password1234!",
+			AdminUsername: "panadmin",
+			ComputerName:  "fw",
+			Image: Image{
+				Offer:     "vmseries-flex",
+				Publisher: "paloaltonetworks",
+				Sku:       "byol",
+				Version:   "latest",
+			},
+			Name:               "fw",
+			NicMap:             NICMAP{Nic0: "mgmt"},
+			StorageAccountType: "Premium_LRS",
+			VmSize:             "Standard_DS3_v2",
+		}},
+		VNET: VNET{
+			AddressSpace: "10.0.0.0/16",
+			NIC: []NIC{{
+				Name:     "mgmt",
+				SnetName: "mgmt",
+			}},
+			SNET: []SNET{{
+				AddressPrefix: "10.0.0.0/24",
+				Name:          "mgmt",
+			}},
+		},
+	}
+}
+
+func TestBuildPlan(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr string
+	}{
+		{
+			name:   "minimal config",
+			modify: func(cfg *Config) {},
+		},
+		{
+			name:   "network only",
+			modify: func(cfg *Config) { cfg.DeployVM, cfg.VMs = false, nil },
+		},
+		{
+			name:    "os disk id too short",
+			modify:  func(cfg *Config) { cfg.OsDiskIdLength = 2 },
+			wantErr: "osDiskIdLength must be between 4 and 32",
+		},
+		{
+			name:    "invalid custom timeout",
+			modify:  func(cfg *Config) { cfg.CustomTimeouts.Create = "soon" },
+			wantErr: "customTimeouts.create",
+		},
+		{
+			name:    "existing resource group without name",
+			modify:  func(cfg *Config) { cfg.ResourceGroup.Existing = true },
+			wantErr: "resourceGroup.name is required",
+		},
+		{
+			name: "nsg rule priorities collide",
+			modify: func(cfg *Config) {
+				rule := Rule{Access: "Allow", Direction: "Inbound", Name: "a", Priority: 100, Protocol: "Tcp"}
+				cfg.VNET.NSG = []NSG{{Name: "mgmt", Rules: []Rule{rule, rule}}}
+				cfg.VNET.NSG[0].Rules[1].Name = "b"
+			},
+			wantErr: `priority 100 is already used by rule "a"`,
+		},
+		{
+			name: "nsg rule in the default rules range",
+			modify: func(cfg *Config) {
+				cfg.DefaultRules = []Rule{{Access: "Deny", Direction: "Inbound", Name: "deny", Priority: 10, Protocol: "*"}}
+				cfg.VNET.NSG = []NSG{{Name: "mgmt", Rules: []Rule{
+					{Access: "Allow", Direction: "Outbound", Name: "own", Priority: 105, Protocol: "Tcp"},
+					{Access: "Allow", Direction: "Outbound", Name: "last", Priority: 110, Protocol: "Tcp"},
+				}}}
+			},
+			wantErr: `rule "last" priority 110 must be above 110, as 100-110 is reserved for default rules`,
+		},
+		{
+			name: "nsg skipping default rules can use their range",
+			modify: func(cfg *Config) {
+				cfg.DefaultRules = []Rule{{Access: "Deny", Direction: "Inbound", Name: "deny", Priority: 10, Protocol: "*"}}
+				cfg.VNET.NSG = []NSG{{Name: "mgmt", Rules: []Rule{{Access: "Allow", Direction: "Inbound", Name: "own", Priority: 110, Protocol: "Tcp"}}, SkipDefaultRules: true}}
+			},
+		},
+		{
+			name: "default rule offset past the last priority",
+			modify: func(cfg *Config) {
+				cfg.DefaultRules = []Rule{{Access: "Deny", Direction: "Inbound", Name: "deny", Priority: 4000, Protocol: "*"}}
+			},
+			wantErr: `default rule "deny" priority 4000 is an offset from defaultRulesPriorityBase 100, so must be between 0 and 3996`,
+		},
+		{
+			name: "default rules priority base out of range",
+			modify: func(cfg *Config) {
+				cfg.DefaultRules = []Rule{{Access: "Deny", Direction: "Inbound", Name: "deny", Protocol: "*"}}
+				cfg.DefaultRulesPriorityBase = 50
+			},
+			wantErr: "defaultRulesPriorityBase must be between 100 and 4096",
+		},
+		{
+			name: "security rule references unknown asg",
+			modify: func(cfg *Config) {
+				cfg.VNET.NSG = []NSG{{Name: "mgmt", Rules: []Rule{{
+					Access:                          "Allow",
+					Direction:                       "Inbound",
+					Name:                            "web",
+					Priority:                        100,
+					Protocol:                        "Tcp",
+					SourceApplicationSecurityGroups: []string{"web"},
+				}}}}
+			},
+			wantErr: `references unknown application security group "web"`,
+		},
+		{
+			name: "flow log without storage account",
+			modify: func(cfg *Config) {
+				cfg.VNET.NSG = []NSG{{FlowLog: FlowLog{Enabled: true}, Name: "mgmt"}}
+			},
+			wantErr: "flow log requires storageAccountId",
+		},
+		{
+			name: "flow log without location",
+			modify: func(cfg *Config) {
+				cfg.VNET.NSG = []NSG{{FlowLog: FlowLog{Enabled: true, StorageAccountId: "id"}, Name: "mgmt"}}
+			},
+			wantErr: "flow log requires networkWatcherName or location",
+		},
+		{
+			name: "flow log with location from existing resource group",
+			modify: func(cfg *Config) {
+				cfg.ResourceGroup = ResourceGroup{Existing: true, Name: "rg"}
+				cfg.VNET.NSG = []NSG{{FlowLog: FlowLog{Enabled: true, StorageAccountId: "id"}, Name: "mgmt"}}
+			},
+		},
+		{
+			name: "route with unknown next hop type",
+			modify: func(cfg *Config) {
+				cfg.VNET.RT = []RT{{Name: "rt", Routes: []Route{{AddressPrefix: "0.0.0.0/0", Name: "default", NextHopType: "Firewall"}}}}
+			},
+			wantErr: `unknown nextHopType "Firewall"`,
+		},
+		{
+			name:    "subnet references unknown nsg",
+			modify:  func(cfg *Config) { cfg.VNET.SNET[0].NSGName = "missing" },
+			wantErr: `references unknown network security group "missing"`,
+		},
+		{
+			name:    "subnet references unknown route table",
+			modify:  func(cfg *Config) { cfg.VNET.SNET[0].RTName = "missing" },
+			wantErr: `references unknown route table "missing"`,
+		},
+		{
+			name:    "subnet with unknown private endpoint policy",
+			modify:  func(cfg *Config) { cfg.VNET.SNET[0].PrivateEndpointNetworkPolicies = "On" },
+			wantErr: "unknown privateEndpointNetworkPolicies",
+		},
+		{
+			name: "nat gateway references unknown public ip",
+			modify: func(cfg *Config) {
+				cfg.VNET.NATGW = []NATGW{{Name: "ng", PipName: "missing"}}
+			},
+			wantErr: `references unknown public ip "missing"`,
+		},
+		{
+			name:    "peering with invalid remote id",
+			modify:  func(cfg *Config) { cfg.VNET.Peerings = []Peering{{Name: "hub", RemoteVirtualNetworkId: "hub"}} },
+			wantErr: "invalid remoteVirtualNetworkId",
+		},
+		{
+			name:    "nic references unknown asg",
+			modify:  func(cfg *Config) { cfg.VNET.NIC[0].ApplicationSecurityGroups = []string{"missing"} },
+			wantErr: `references unknown application security group "missing"`,
+		},
+		{
+			name:    "nic with invalid dns server",
+			modify:  func(cfg *Config) { cfg.VNET.NIC[0].DnsServers = []string{"dns"} },
+			wantErr: `invalid dns server "dns"`,
+		},
+		{
+			name:    "dns record without zone",
+			modify:  func(cfg *Config) { cfg.VNET.PIP = []PIP{{DnsRecordName: "fw", Name: "mgmt"}} },
+			wantErr: "dnsRecordName requires dnsZone.name",
+		},
+		{
+			name:    "os disk too small",
+			modify:  func(cfg *Config) { cfg.VMs[0].OsDiskSizeGB = 10 },
+			wantErr: "osDiskSizeGB 10 is outside the allowed range",
+		},
+		{
+			name: "data disks share a lun",
+			modify: func(cfg *Config) {
+				cfg.VMs[0].DataDisks = []DataDisk{{DiskSizeGB: 32, Name: "a"}, {DiskSizeGB: 32, Name: "b"}}
+			},
+			wantErr: `data disks "a" and "b" share lun 0`,
+		},
+		{
+			name:    "unknown identity type",
+			modify:  func(cfg *Config) { cfg.VMs[0].Identity.Type = "Managed" },
+			wantErr: `unknown identity type "Managed"`,
+		},
+		{
+			name:   "latest image with pinLatest",
+			modify: func(cfg *Config) { cfg.PinLatest = true },
+		},
+		{
+			name: "unversioned gallery image with pinLatest",
+			modify: func(cfg *Config) {
+				cfg.PinLatest = true
+				cfg.VMs[0].Image = Image{Id: "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/galleries/gallery/images/panos"}
+			},
+		},
+		{
+			name: "custom data with bootstrap",
+			modify: func(cfg *Config) {
+				cfg.Bootstrap = Bootstrap{FileShare: "bootstrap", StorageAccountName: "stbootstrap"}
+				cfg.VMs[0].CustomData = "type=dhcp-client"
+			},
+			wantErr: "cannot set customData or customDataFile when bootstrap is configured",
+		},
+		{
+			name: "extension settings that aren't json",
+			modify: func(cfg *Config) {
+				cfg.VMs[0].Extensions = []Extension{{Name: "ext", Settings: map[string]interface{}{"f": func() {}}}}
+			},
+			wantErr: `extension "ext" settings are not valid json`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			test.modify(&cfg)
+			_, err := buildPlan(cfg)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("buildPlan() error = %v, want none", err)
+			case test.wantErr != "" && err == nil:
+				t.Fatalf("buildPlan() error = nil, want %q", test.wantErr)
+			case test.wantErr != "" && !strings.Contains(err.Error(), test.wantErr):
+				t.Fatalf("buildPlan() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildPlanKeepsConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.DefaultRules = []Rule{{Access: "Deny", Direction: "Inbound", Name: "deny", Priority: 96, Protocol: "*"}}
+	cfg.Environment = "dev"
+	cfg.VMs[0].LoggingVolume = LoggingVolume{DiskCount: 2, DiskSizeGB: 64}
+	cfg.VNET.NSG = []NSG{{Name: "mgmt"}}
+	want := testConfig()
+	want.DefaultRules = []Rule{{Access: "Deny", Direction: "Inbound", Name: "deny", Priority: 96, Protocol: "*"}}
+	want.Environment = "dev"
+	want.VMs[0].LoggingVolume = LoggingVolume{DiskCount: 2, DiskSizeGB: 64}
+	want.VNET.NSG = []NSG{{Name: "mgmt"}}
+
+	plan, err := buildPlan(cfg)
+	if err != nil {
+		t.Fatalf("buildPlan() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("buildPlan() modified its config:\ngot  %+v\nwant %+v", cfg, want)
+	}
+	if got := len(plan.VNET.NIC[0].IpConfigurations); got != 1 {
+		t.Errorf("plan nic has %d ip configurations, want 1", got)
+	}
+	if got := plan.VNET.NSG[0].Rules; len(got) != 1 || got[0].Priority != 196 {
+		t.Errorf("plan nsg rules = %+v, want the default rule at priority 196", got)
+	}
+	if got := len(plan.VMs[0].DataDisks); got != 2 {
+		t.Errorf("plan vm has %d data disks, want the 2 logging volume disks", got)
+	}
+}
+
+func TestBuildPlanSettings(t *testing.T) {
+	protect := false
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		check  func(t *testing.T, plan *Plan)
+	}{
+		{
+			name:   "default name prefix",
+			modify: func(cfg *Config) {},
+			check: func(t *testing.T, plan *Plan) {
+				if plan.NameSuffix != "panos-vm-test-" {
+					t.Errorf("NameSuffix = %q, want %q", plan.NameSuffix, "panos-vm-test-")
+				}
+			},
+		},
+		{
+			name:   "custom name prefix",
+			modify: func(cfg *Config) { cfg.NamePrefix = "fw" },
+			check: func(t *testing.T, plan *Plan) {
+				if plan.NameSuffix != "fw-test-" {
+					t.Errorf("NameSuffix = %q, want %q", plan.NameSuffix, "fw-test-")
+				}
+			},
+		},
+		{
+			name:   "prod preset protects resources",
+			modify: func(cfg *Config) { cfg.Environment = "prod" },
+			check: func(t *testing.T, plan *Plan) {
+				if !plan.ProtectResources {
+					t.Error("ProtectResources = false, want the prod preset's true")
+				}
+			},
+		},
+		{
+			name:   "protectResources overrides the preset",
+			modify: func(cfg *Config) { cfg.Environment, cfg.ProtectResources = "prod", &protect },
+			check: func(t *testing.T, plan *Plan) {
+				if plan.ProtectResources {
+					t.Error("ProtectResources = true, want the configured false")
+				}
+			},
+		},
+		{
+			name: "ha pair is dropped without vms",
+			modify: func(cfg *Config) {
+				cfg.DeployVM, cfg.VMs = false, nil
+				cfg.HaPair = HaPair{Name: "ha"}
+			},
+			check: func(t *testing.T, plan *Plan) {
+				if plan.HaPair.Name != "" {
+					t.Errorf("HaPair.Name = %q, want none", plan.HaPair.Name)
+				}
+			},
+		},
+		{
+			name: "marketplace terms only when accepted",
+			modify: func(cfg *Config) {
+				cfg.VMs = append(cfg.VMs, cfg.VMs[0])
+				cfg.VMs[1].Name, cfg.VMs[1].NicMap = "fw2", NICMAP{}
+			},
+			check: func(t *testing.T, plan *Plan) {
+				if len(plan.MarketplaceAgreements) != 0 {
+					t.Errorf("MarketplaceAgreements = %v, want none", plan.MarketplaceAgreements)
+				}
+			},
+		},
+		{
+			name: "marketplace terms once per plan",
+			modify: func(cfg *Config) {
+				cfg.AcceptMarketplaceTerms = true
+				cfg.VMs = append(cfg.VMs, cfg.VMs[0])
+				cfg.VMs[1].Name, cfg.VMs[1].NicMap = "fw2", NICMAP{}
+			},
+			check: func(t *testing.T, plan *Plan) {
+				want := []ImagePlan{{Name: "byol", Product: "vmseries-flex", Publisher: "paloaltonetworks"}}
+				if !reflect.DeepEqual(plan.MarketplaceAgreements, want) {
+					t.Errorf("MarketplaceAgreements = %v, want %v", plan.MarketplaceAgreements, want)
+				}
+			},
+		},
+		{
+			name: "next hop without ip forwarding warns",
+			modify: func(cfg *Config) {
+				cfg.VNET.NIC[0].PrivateIpAddress = "10.0.0.4"
+				cfg.VNET.RT = []RT{{Name: "rt", Routes: []Route{{
+					AddressPrefix:    "0.0.0.0/0",
+					Name:             "default",
+					NextHopIpAddress: "10.0.0.4",
+					NextHopType:      "VirtualAppliance",
+				}}}}
+			},
+			check: func(t *testing.T, plan *Plan) {
+				if len(plan.Warnings) != 1 || !strings.Contains(plan.Warnings[0], "enableIPForwarding") {
+					t.Errorf("Warnings = %v, want one about enableIPForwarding", plan.Warnings)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			test.modify(&cfg)
+			plan, err := buildPlan(cfg)
+			if err != nil {
+				t.Fatalf("buildPlan() error = %v", err)
+			}
+			test.check(t, plan)
+		})
+	}
+}
+
+func TestBuildPlanEnvironment(t *testing.T) {
+	tests := []struct {
+		name         string
+		environment  string
+		stack        string
+		wantPriority string
+		wantErr      string
+	}{
+		{name: "unset on a dev stack", stack: "dev"},
+		{name: "explicit dev", environment: "dev", stack: "test", wantPriority: "Spot"},
+		{name: "unknown", environment: "staging", wantErr: `unknown environment "staging"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Environment, cfg.Stack = test.environment, valueOrDefault(test.stack, cfg.Stack)
+			plan, err := buildPlan(cfg)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("buildPlan() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildPlan() error = %v", err)
+			}
+			if plan.VMs[0].Priority != test.wantPriority {
+				t.Errorf("vm priority = %q, want %q", plan.VMs[0].Priority, test.wantPriority)
+			}
+		})
+	}
+}
+
+func TestApplyEnvironmentPreset(t *testing.T) {
+	dev := environmentPresets["dev"]
+	prod := environmentPresets["prod"]
+	tests := []struct {
+		name   string
+		vm     VM
+		preset EnvironmentPreset
+		want   VM
+	}{
+		{
+			name:   "fills unset settings",
+			preset: dev,
+			want:   VM{EvictionPolicy: "Deallocate", OsDiskSizeGB: 64, Priority: "Spot"},
+		},
+		{
+			name:   "config wins over the preset",
+			vm:     VM{OsDiskSizeGB: 256, Priority: "Regular", Zone: "2"},
+			preset: EnvironmentPreset{EvictionPolicy: "Deallocate", OsDiskSizeGB: 64, Priority: "Spot", Zone: "1"},
+			want:   VM{OsDiskSizeGB: 256, Priority: "Regular", Zone: "2"},
+		},
+		{
+			name:   "keeps the configured eviction policy",
+			vm:     VM{EvictionPolicy: "Delete"},
+			preset: dev,
+			want:   VM{EvictionPolicy: "Delete", OsDiskSizeGB: 64, Priority: "Spot"},
+		},
+		{
+			name:   "no zone with an availability set",
+			vm:     VM{AvailabilitySet: AvailabilitySet{Name: "fw"}},
+			preset: prod,
+			want:   VM{AvailabilitySet: AvailabilitySet{Name: "fw"}},
+		},
+		{
+			name:   "no zone with an availability set id",
+			vm:     VM{AvailabilitySetId: "id"},
+			preset: prod,
+			want:   VM{AvailabilitySetId: "id"},
+		},
+		{
+			name:   "no spot with hibernation",
+			vm:     VM{HibernationEnabled: true},
+			preset: dev,
+			want:   VM{HibernationEnabled: true, OsDiskSizeGB: 64},
+		},
+		{
+			name:   "no smaller os disk for windows",
+			vm:     VM{OsType: "Windows"},
+			preset: dev,
+			want:   VM{EvictionPolicy: "Deallocate", OsType: "Windows", Priority: "Spot"},
+		},
+		{
+			name:   "empty preset changes nothing",
+			vm:     VM{Name: "fw"},
+			preset: environmentPresets["test"],
+			want:   VM{Name: "fw"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := applyEnvironmentPreset(test.vm, test.preset); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("applyEnvironmentPreset() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeResources(t *testing.T) {
+	tests := []struct {
+		name string
+		vnet VNET
+		vms  []VM
+		want ResourceCounts
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "populated",
+			vnet: VNET{
+				NIC: []NIC{{Name: "mgmt"}, {Name: "data"}, {Existing: true, Name: "shared"}},
+				NSG: []NSG{{Name: "mgmt"}},
+				PIP: []PIP{{Name: "mgmt"}, {Existing: true, Name: "shared"}},
+				RT:  []RT{{Name: "data"}, {Name: "mgmt"}},
+				SNET: []SNET{
+					{Name: "mgmt"},
+					{Existing: true, Name: "shared"},
+				},
+			},
+			vms: []VM{{Name: "fw1"}, {Name: "fw2"}},
+			want: ResourceCounts{
+				NICs:        2,
+				NSGs:        1,
+				PublicIPs:   1,
+				RouteTables: 2,
+				Subnets:     1,
+				VMs:         2,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := summarizeResources(test.vnet, test.vms); got != test.want {
+				t.Errorf("summarizeResources() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildNetworkInterfaceReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       NICMAP
+		want    []string
+		wantErr string
+	}{
+		{name: "no nics", wantErr: "nic map must reference at least one nic"},
+		{name: "one nic", m: NICMAP{Nic0: "mgmt"}, want: []string{"mgmt"}},
+		{name: "three nics", m: NICMAP{Nic0: "mgmt", Nic1: "data", Nic2: "ha"}, want: []string{"mgmt", "data", "ha"}},
+		{name: "blank nic skipped", m: NICMAP{Nic0: "mgmt", Nic2: "ha"}, want: []string{"mgmt", "ha"}},
+		{name: "primary from first given nic", m: NICMAP{Nic1: "data"}, want: []string{"data"}},
+		{name: "unknown nic", m: NICMAP{Nic0: "mgmt", Nic1: "untrust"}, wantErr: `nic map references unknown nic "untrust"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotIds []string
+			var gotPrimary []bool
+			err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+				nicMap := make(map[string]*network.NetworkInterface)
+				for _, name := range []string{"data", "ha", "mgmt"} {
+					nic, err := network.NewNetworkInterface(ctx, name, &network.NetworkInterfaceArgs{
+						ResourceGroupName: pulumi.String("rg"),
+					})
+					if err != nil {
+						return err
+					}
+					nicMap[name] = nic
+				}
+				references, err := buildNetworkInterfaceReferences(test.m, nicMap)
+				if err != nil {
+					return err
+				}
+				var ids []interface{}
+				for _, reference := range references {
+					reference := reference.(compute.NetworkInterfaceReferenceArgs)
+					ids = append(ids, reference.Id)
+					gotPrimary = append(gotPrimary, bool(reference.Primary.(pulumi.Bool)))
+				}
+				var wg sync.WaitGroup
+				wg.Add(1)
+				pulumi.All(ids...).ApplyT(func(ids []interface{}) error {
+					defer wg.Done()
+					for _, id := range ids {
+						gotIds = append(gotIds, string(id.(pulumi.ID)))
+					}
+					return nil
+				})
+				wg.Wait()
+				return nil
+			}, pulumi.WithMocks("project", "test", &mocks{}))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("buildNetworkInterfaceReferences() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildNetworkInterfaceReferences() error = %v", err)
+			}
+			var wantIds []string
+			var wantPrimary []bool
+			for i, name := range test.want {
+				wantIds = append(wantIds, name+"_id")
+				wantPrimary = append(wantPrimary, i == 0)
+			}
+			if !reflect.DeepEqual(gotIds, wantIds) {
+				t.Errorf("reference ids = %v, want %v", gotIds, wantIds)
+			}
+			if !reflect.DeepEqual(gotPrimary, wantPrimary) {
+				t.Errorf("reference primary = %v, want %v", gotPrimary, wantPrimary)
+			}
+		})
+	}
+}
+
+func TestValidateDiskName(t *testing.T) {
+	tests := []struct {
+		name    string
+		disk    string
+		wantErr string
+	}{
+		{name: "os disk", disk: "os-fw-panos-vm-dev-a1b2c3d4"},
+		{name: "data disk", disk: "data-logs-fw-panos-vm-dev-a1b2c3d4"},
+		{name: "periods and underscores", disk: "os_fw.panos_"},
+		{name: "80 characters", disk: strings.Repeat("a", 80)},
+		{name: "81 characters", disk: strings.Repeat("a", 81), wantErr: "longer than 80 characters"},
+		{name: "leading hyphen", disk: "-os", wantErr: "may only contain"},
+		{name: "trailing period", disk: "os.", wantErr: "may only contain"},
+		{name: "trailing hyphen", disk: "os-", wantErr: "may only contain"},
+		{name: "space", disk: "os disk", wantErr: "may only contain"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateDiskName(test.disk)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("validateDiskName(%q) error = %v, want none", test.disk, err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Fatalf("validateDiskName(%q) error = %v, want %q", test.disk, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestBuildPlanDiskNames(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		wantErr string
+	}{
+		{
+			name:   "longest random id",
+			modify: func(cfg *Config) { cfg.OsDiskIdLength = 32 },
+		},
+		{
+			name: "data disk",
+			modify: func(cfg *Config) {
+				cfg.VMs[0].DataDisks = []DataDisk{{DiskSizeGB: 32, Name: "logs"}}
+			},
+		},
+		{
+			name: "os disk name too long",
+			modify: func(cfg *Config) {
+				cfg.NamePrefix = strings.Repeat("p", 40)
+				cfg.OsDiskIdLength = 32
+			},
+			wantErr: "longer than 80 characters",
+		},
+		{
+			name: "data disk name too long",
+			modify: func(cfg *Config) {
+				cfg.VMs[0].DataDisks = []DataDisk{{DiskSizeGB: 32, Name: strings.Repeat("d", 50)}}
+			},
+			wantErr: "longer than 80 characters",
+		},
+		{
+			name: "data disk name with invalid characters",
+			modify: func(cfg *Config) {
+				cfg.VMs[0].DataDisks = []DataDisk{{DiskSizeGB: 32, Name: "logs/1"}}
+			},
+			wantErr: "may only contain",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			test.modify(&cfg)
+			_, err := buildPlan(cfg)
+			switch {
+			case test.wantErr == "" && err != nil:
+				t.Fatalf("buildPlan() error = %v, want none", err)
+			case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+				t.Fatalf("buildPlan() error = %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCidrsOverlap(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "disjoint ipv4", a: "10.0.0.0/24", b: "10.0.1.0/24"},
+		{name: "adjacent ipv4", a: "10.0.0.0/25", b: "10.0.0.128/25"},
+		{name: "equal ipv4", a: "10.0.0.0/24", b: "10.0.0.0/24", want: true},
+		{name: "partial ipv4", a: "10.0.0.0/23", b: "10.0.1.0/24", want: true},
+		{name: "ipv4 contains", a: "10.0.0.0/16", b: "10.0.5.0/24", want: true},
+		{name: "ipv4 contained", a: "10.0.5.0/24", b: "10.0.0.0/16", want: true},
+		{name: "disjoint ipv6", a: "fd00:0:0:1::/64", b: "fd00:0:0:2::/64"},
+		{name: "equal ipv6", a: "fd00::/64", b: "fd00::/64", want: true},
+		{name: "ipv6 contains", a: "fd00::/48", b: "fd00:0:0:7::/64", want: true},
+		{name: "ipv6 contained", a: "fd00:0:0:7::/64", b: "fd00::/48", want: true},
+		{name: "mixed family", a: "10.0.0.0/8", b: "fd00::/8"},
+		{name: "ipv4 mapped ipv6", a: "10.0.0.0/24", b: "::ffff:10.0.0.0/120"},
+		{name: "invalid first", a: "10.0.0.0", b: "10.0.0.0/24", wantErr: true},
+		{name: "invalid second", a: "10.0.0.0/24", b: "10.0.0.0/33", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := cidrsOverlap(test.a, test.b)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("cidrsOverlap(%q, %q) error = %v, want error %v", test.a, test.b, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Fatalf("cidrsOverlap(%q, %q) = %v, want %v", test.a, test.b, got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplySubnetAssociations(t *testing.T) {
+	tests := []struct {
+		name            string
+		nsgName, rtName string
+		wantNSG, wantRT string
+	}{
+		{name: "neither"},
+		{name: "nsg only", nsgName: "mgmt", wantNSG: "nsg-mgmt-panos-vm-test-"},
+		{name: "route table only", rtName: "mgmt", wantRT: "rt-mgmt-panos-vm-test-"},
+		{name: "both", nsgName: "mgmt", rtName: "mgmt", wantNSG: "nsg-mgmt-panos-vm-test-", wantRT: "rt-mgmt-panos-vm-test-"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.VNET.NSG = []NSG{{Name: "mgmt"}}
+			cfg.VNET.RT = []RT{{Name: "mgmt"}}
+			cfg.VNET.SNET[0].NSGName, cfg.VNET.SNET[0].RTName = test.nsgName, test.rtName
+			m := runApply(t, cfg)
+
+			subnet, exists := m.byType("azure-native:network/v20240501:Subnet")["snet-mgmt"]
+			if !exists {
+				t.Fatal("subnet snet-mgmt was not registered")
+			}
+			for _, association := range []struct{ key, want string }{
+				{"networkSecurityGroup", test.wantNSG},
+				{"routeTable", test.wantRT},
+			} {
+				value, exists := subnet.Inputs[resource.PropertyKey(association.key)]
+				if association.want == "" {
+					if exists {
+						t.Errorf("subnet %s = %v, want none", association.key, value)
+					}
+					continue
+				}
+				if !exists || !value.IsObject() {
+					t.Fatalf("subnet %s is not set", association.key)
+				}
+				if id := value.ObjectValue()["id"]; !id.IsString() || id.StringValue() != association.want+"_id" {
+					t.Errorf("subnet %s.id = %v, want %q", association.key, id, association.want+"_id")
+				}
+				if !dependsOn(subnet, association.want) {
+					t.Errorf("subnet does not depend on %s", association.want)
+				}
+			}
+		})
+	}
+}
+
+// dependsOn reports whether a registered resource depends on the resource with the given logical name.
+func dependsOn(args pulumi.MockResourceArgs, name string) bool {
+	for _, dependency := range args.RegisterRPC.GetDependencies() {
+		if strings.HasSuffix(dependency, "::"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApplyFlatHierarchy(t *testing.T) {
+	// Each resource with the logical name of the resource it is parented to when the hierarchy isn't flat.
+	children := []struct{ typeToken, name, parent string }{
+		{"azure-native:network:VirtualNetwork", "vnet-panos-vm-test-", "rg-panos-vm-test-"},
+		{"azure-native:network/v20240501:Subnet", "snet-mgmt", "vnet-panos-vm-test-"},
+		{"azure-native:network:NetworkSecurityGroup", "nsg-mgmt-panos-vm-test-", "rg-panos-vm-test-"},
+		{"azure-native:network:NetworkInterface", "nic-mgmt-panos-vm-test-", "rg-panos-vm-test-"},
+		{"azure-native:compute:VirtualMachine", "vm-fw-panos-vm-test-", "rg-panos-vm-test-"},
+	}
+	for _, flat := range []bool{false, true} {
+		t.Run(map[bool]string{false: "nested", true: "flat"}[flat], func(t *testing.T) {
+			cfg := testConfig()
+			cfg.FlatHierarchy = flat
+			cfg.VNET.NSG = []NSG{{Name: "mgmt"}}
+			m := runApply(t, cfg)
+			for _, child := range children {
+				args, exists := m.byType(child.typeToken)[child.name]
+				if !exists {
+					t.Fatalf("%s was not registered", child.name)
+				}
+				parent := args.RegisterRPC.GetParent()
+				if flat {
+					if !strings.HasSuffix(parent, "pulumi:pulumi:Stack::project-test") {
+						t.Errorf("%s parent = %q, want the stack", child.name, parent)
+					}
+				} else if !strings.HasSuffix(parent, "::"+child.parent) {
+					t.Errorf("%s parent = %q, want %s", child.name, parent, child.parent)
+				}
+				if !dependsOn(args, child.parent) {
+					t.Errorf("%s does not depend on %s", child.name, child.parent)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyIsDeterministic(t *testing.T) {
+	cfg := testConfig()
+	cfg.VNET.NSG = []NSG{{Name: "data"}, {Name: "ha"}, {Name: "mgmt"}}
+	cfg.VNET.RT = []RT{{Name: "data"}, {Name: "ha"}}
+	cfg.VNET.NIC = []NIC{
+		{Name: "data", SnetName: "data"},
+		{Name: "ha", SnetName: "ha"},
+		{Name: "mgmt", SnetName: "mgmt"},
+	}
+	cfg.VNET.SNET = []SNET{
+		{AddressPrefix: "10.0.1.0/24", Name: "data", NSGName: "data", RTName: "data"},
+		{AddressPrefix: "10.0.2.0/24", Name: "ha", NSGName: "ha", RTName: "ha"},
+		{AddressPrefix: "10.0.0.0/24", Name: "mgmt", NSGName: "mgmt"},
+	}
+	cfg.VMs[0].NicMap = NICMAP{Nic0: "mgmt", Nic1: "data", Nic2: "ha"}
+
+	// dependencies returns each registered resource's sorted dependencies, keyed by its type token and logical name.
+	dependencies := func() map[string][]string {
+		m := runApply(t, cfg)
+		got := make(map[string][]string)
+		for key, args := range m.resources {
+			got[key] = slices.Sorted(slices.Values(args.RegisterRPC.GetDependencies()))
+		}
+		return got
+	}
+	want := dependencies()
+	for range 5 {
+		if got := dependencies(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("dependencies differ between runs:\n%v\n%v", got, want)
+		}
+	}
+}
+
+func TestApplyDependencies(t *testing.T) {
+	cfg := testConfig()
+	cfg.VNET.NATGW = []NATGW{{Name: "data", PipName: "ng"}}
+	cfg.VNET.NIC = []NIC{
+		{Name: "data", SnetName: "data"},
+		{Name: "mgmt", PipName: "mgmt", SnetName: "mgmt"},
+	}
+	cfg.VNET.NSG = []NSG{{Name: "data"}, {Name: "mgmt"}}
+	cfg.VNET.PIP = []PIP{
+		{AllocationMethod: "Static", Name: "mgmt", SkuName: "Standard"},
+		{AllocationMethod: "Static", Name: "ng", SkuName: "Standard"},
+	}
+	cfg.VNET.RT = []RT{{Name: "data"}}
+	cfg.VNET.SNET = []SNET{
+		{AddressPrefix: "10.0.1.0/24", Name: "data", NatGatewayName: "data", NSGName: "data", RTName: "data"},
+		{AddressPrefix: "10.0.0.0/24", Name: "mgmt", NSGName: "mgmt"},
+	}
+	cfg.VMs[0].NicMap = NICMAP{Nic0: "mgmt", Nic1: "data"}
+	m := runApply(t, cfg)
+
+	tests := []struct {
+		typeToken, name string
+		want            []string
+	}{
+		{
+			typeToken: "azure-native:network/v20240501:Subnet",
+			name:      "snet-data",
+			want:      []string{"ng-data-panos-vm-test-", "nsg-data-panos-vm-test-", "rg-panos-vm-test-", "rt-data-panos-vm-test-", "vnet-panos-vm-test-"},
+		},
+		{
+			typeToken: "azure-native:network/v20240501:Subnet",
+			name:      "snet-mgmt",
+			want:      []string{"nsg-mgmt-panos-vm-test-", "rg-panos-vm-test-", "vnet-panos-vm-test-"},
+		},
+		{
+			typeToken: "azure-native:network:NetworkInterface",
+			name:      "nic-data-panos-vm-test-",
+			want:      []string{"rg-panos-vm-test-", "snet-data"},
+		},
+		{
+			typeToken: "azure-native:network:NetworkInterface",
+			name:      "nic-mgmt-panos-vm-test-",
+			want:      []string{"pip-mgmt-panos-vm-test-", "rg-panos-vm-test-", "snet-mgmt"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, exists := m.byType(test.typeToken)[test.name]
+			if !exists {
+				t.Fatalf("%s was not registered", test.name)
+			}
+			var got []string
+			for _, dependency := range args.RegisterRPC.GetDependencies() {
+				got = append(got, dependency[strings.LastIndex(dependency, "::")+2:])
+			}
+			slices.Sort(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s dependencies = %v, want %v", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestApplyMarketplaceAgreements(t *testing.T) {
+	cfg := testConfig()
+	cfg.AcceptMarketplaceTerms = true
+	cfg.VMs = append(cfg.VMs, cfg.VMs[0])
+	cfg.VMs[1].Name, cfg.VMs[1].NicMap = "fw2", NICMAP{}
+	m := runApply(t, cfg)
+
+	agreements := m.byType("azure-native:marketplaceordering:MarketplaceAgreement")
+	if len(agreements) != 1 {
+		t.Fatalf("%d agreements registered, want one for the shared plan", len(agreements))
+	}
+	for name, agreement := range agreements {
+		want := resource.NewPropertyMapFromMap(map[string]interface{}{
+			"offerId":     "vmseries-flex",
+			"offerType":   "virtualmachine",
+			"planId":      "byol",
+			"properties":  map[string]interface{}{"accepted": true},
+			"publisherId": "paloaltonetworks",
+		})
+		if !agreement.Inputs.DeepEquals(want) {
+			t.Errorf("agreement inputs = %v, want %v", agreement.Inputs, want)
+		}
+		for _, vm := range m.byType("azure-native:compute:VirtualMachine") {
+			if !slices.ContainsFunc(vm.RegisterRPC.GetDependencies(), func(dependency string) bool {
+				return strings.HasSuffix(dependency, "::"+name)
+			}) {
+				t.Errorf("vm %s does not depend on agreement %s", vm.Name, name)
+			}
+		}
+	}
+}
+
+// agentMocks is a mocks whose VM instance views report a ready VM agent, counting the instance view lookups.
+type agentMocks struct {
+	mocks
+	mu      sync.Mutex
+	lookups int
+}
+
+func (m *agentMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	if args.Token != "azure-native:compute:getVirtualMachine" {
+		return m.mocks.Call(args)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lookups++
+	return resource.NewPropertyMapFromMap(map[string]interface{}{
+		"instanceView": map[string]interface{}{
+			"vmAgent": map[string]interface{}{
+				"statuses": []interface{}{map[string]interface{}{"displayStatus": "Ready"}},
+			},
+		},
+	}), nil
+}
+
+func TestApplyWaitForAgentReady(t *testing.T) {
+	tests := []struct {
+		name        string
+		dryRun      bool
+		wantLookups int
+	}{
+		{name: "preview", dryRun: true},
+		{name: "update", wantLookups: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.VMs[0].WaitForAgentReady = true
+			plan, err := buildPlan(cfg)
+			if err != nil {
+				t.Fatalf("buildPlan() error = %v", err)
+			}
+			m := &agentMocks{}
+			err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+				return apply(ctx, plan)
+			}, pulumi.WithMocks("project", "test", m), func(info *pulumi.RunInfo) { info.DryRun = test.dryRun })
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if m.lookups != test.wantLookups {
+				t.Errorf("instance view lookups = %d, want %d", m.lookups, test.wantLookups)
+			}
+		})
+	}
+}
+
+func TestBuildPlanDeploymentBatch(t *testing.T) {
+	tests := []struct {
+		name            string
+		tag             bool
+		deploymentBatch string
+		wantWarnings    int
+	}{
+		{name: "disabled"},
+		{name: "per run", tag: true},
+		{name: "configured", tag: true, deploymentBatch: "release-42"},
+		{name: "configured without tagging", deploymentBatch: "release-42", wantWarnings: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.TagDeploymentBatch, cfg.DeploymentBatch = test.tag, test.deploymentBatch
+			plan, err := buildPlan(cfg)
+			if err != nil {
+				t.Fatalf("buildPlan() error = %v", err)
+			}
+			if plan.TagDeploymentBatch != test.tag || plan.DeploymentBatch != test.deploymentBatch || len(plan.Warnings) != test.wantWarnings {
+				t.Errorf("TagDeploymentBatch = %v, DeploymentBatch = %q, Warnings = %v, want %v, %q and %d warnings",
+					plan.TagDeploymentBatch, plan.DeploymentBatch, plan.Warnings, test.tag, test.deploymentBatch, test.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestApplyDeploymentBatchTags(t *testing.T) {
+	keys := []string{
+		"azure-native:resources:ResourceGroup::rg-panos-vm-test-",
+		"azure-native:network:VirtualNetwork::vnet-panos-vm-test-",
+		"azure-native:compute:VirtualMachine::vm-fw-panos-vm-test-",
+	}
+	// batches returns the deployment-batch tag of each resource in keys.
+	batches := func(t *testing.T, m *recordingMocks) []string {
+		t.Helper()
+		var batches []string
+		for _, key := range keys {
+			tags := m.resources[key].Inputs["tags"]
+			if !tags.IsObject() || !tags.ObjectValue()["deployment-batch"].IsString() {
+				t.Fatalf("%s tags = %v, want a deployment-batch", key, tags)
+			}
+			batches = append(batches, tags.ObjectValue()["deployment-batch"].StringValue())
+		}
+		return batches
+	}
+
+	for _, inherit := range []bool{false, true} {
+		t.Run(map[bool]string{false: "not inherited", true: "inherited"}[inherit], func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DeploymentBatch, cfg.InheritResourceGroupTags, cfg.TagDeploymentBatch = "release-42", inherit, true
+			for i, batch := range batches(t, runApply(t, cfg)) {
+				if batch != "release-42" {
+					t.Errorf("%s deployment-batch = %q, want release-42", keys[i], batch)
+				}
+			}
+		})
+	}
+	t.Run("per run", func(t *testing.T) {
+		cfg := testConfig()
+		cfg.TagDeploymentBatch = true
+		first, second := batches(t, runApply(t, cfg)), batches(t, runApply(t, cfg))
+		if len(first[0]) != 8 || slices.ContainsFunc(first, func(batch string) bool { return batch != first[0] }) {
+			t.Errorf("deployment-batch = %v, want one 8 character id on every resource", first)
+		}
+		if first[0] == second[0] {
+			t.Errorf("deployment-batch = %q on both runs, want a new id per run", first[0])
+		}
+	})
+}
+
+func TestCompareImageVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{a: "11.1.4", b: "11.1.4", want: 0},
+		{a: "11.1.4", b: "11.1.3", want: 1},
+		{a: "10.2.0", b: "9.1.0", want: 1},
+		{a: "9.1.0", b: "10.2.0", want: -1},
+		{a: "11.1.10", b: "11.1.9", want: 1},
+		{a: "11.1", b: "11.1.0", want: -1},
+		{a: "11.1.4-h1", b: "11.1.4", want: 1},
+	}
+	for _, test := range tests {
+		if got := compareImageVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareImageVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// clientMocks is a recordingMocks that answers the provider's client config and token lookups.
+type clientMocks struct {
+	recordingMocks
+}
+
+func (m *clientMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	switch args.Token {
+	case "azure-native:authorization:getClientConfig":
+		return resource.NewPropertyMapFromMap(map[string]interface{}{"subscriptionId": "sub"}), nil
+	case "azure-native:authorization:getClientToken":
+		return resource.NewPropertyMapFromMap(map[string]interface{}{"token": "token"}), nil
+	}
+	return m.recordingMocks.Call(args)
+}
+
+func TestApplyPinLatest(t *testing.T) {
+	const (
+		galleryImageId  = "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/galleries/gallery/images/panos"
+		marketplacePath = "/subscriptions/sub/providers/Microsoft.Compute/locations/eastus/publishers/paloaltonetworks/artifacttypes/vmimage/offers/vmseries-flex/skus/byol/versions"
+	)
+	tests := []struct {
+		name     string
+		image    Image
+		response string
+		status   int
+		wantPath string
+		// wantKey and want are the image reference property the resolved version is set in, and its value.
+		wantKey, want string
+		wantErr       string
+	}{
+		{
+			name:     "newest marketplace version",
+			response: `[{"name":"10.2.9"},{"name":"11.1.10"},{"name":"11.1.9"}]`,
+			status:   http.StatusOK,
+			wantPath: marketplacePath,
+			wantKey:  "version",
+			want:     "11.1.10",
+		},
+		{name: "no marketplace versions", response: `[]`, status: http.StatusOK, wantPath: marketplacePath, wantErr: "has no versions in eastus"},
+		{name: "unknown offer", status: http.StatusNotFound, wantPath: marketplacePath, wantErr: "404 Not Found"},
+		{
+			name:     "newest gallery version",
+			image:    Image{Id: galleryImageId},
+			response: `{"value":[{"name":"1.0.0"},{"name":"1.2.0","properties":{"publishingProfile":{"excludeFromLatest":true}}},{"name":"1.1.0"}]}`,
+			status:   http.StatusOK,
+			wantPath: galleryImageId + "/versions",
+			wantKey:  "id",
+			want:     galleryImageId + "/versions/1.1.0",
+		},
+		{
+			name:     "no gallery versions",
+			image:    Image{Id: galleryImageId},
+			response: `{"value":[{"name":"1.2.0","properties":{"publishingProfile":{"excludeFromLatest":true}}}]}`,
+			status:   http.StatusOK,
+			wantPath: galleryImageId + "/versions",
+			wantErr:  "has no versions that aren't excluded from latest",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != test.wantPath || r.Header.Get("Authorization") != "Bearer token" {
+					t.Errorf("request = %s with %q, want %s with the provider's token", r.URL.Path, r.Header.Get("Authorization"), test.wantPath)
+				}
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			cfg := testConfig()
+			cfg.Location, cfg.PinLatest, cfg.ResourceManagerEndpoint = "eastus", true, server.URL
+			if test.image.Id != "" {
+				cfg.VMs[0].Image = test.image
+			}
+			plan, err := buildPlan(cfg)
+			if err != nil {
+				t.Fatalf("buildPlan() error = %v", err)
+			}
+			m := &clientMocks{}
+			err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+				return apply(ctx, plan)
+			}, pulumi.WithMocks("project", "test", m))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("apply() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			vm := m.byType("azure-native:compute:VirtualMachine")["vm-fw-panos-vm-test-"]
+			got := vm.Inputs["storageProfile"].ObjectValue()["imageReference"].ObjectValue()[resource.PropertyKey(test.wantKey)]
+			if got != resource.NewStringProperty(test.want) {
+				t.Errorf("image %s = %v, want %q", test.wantKey, got, test.want)
+			}
+			if ignored := vm.RegisterRPC.GetIgnoreChanges(); !slices.Equal(ignored, []string{"storageProfile.imageReference." + test.wantKey}) {
+				t.Errorf("ignored changes = %v, want the image %s", ignored, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestReadKeyVaultSecret(t *testing.T) {
+	tests := []struct {
+		name     string
+		secretId string
+		dryRun   bool
+		wantErr  string
+	}{
+		{name: "preview doesn't read the vault", secretId: "https://kv-panos.vault.azure.net/secrets/panadmin", dryRun: true},
+		{name: "not a secret uri", secretId: "https://kv-panos.example.com/secrets/panadmin", wantErr: "is not a key vault secret uri"},
+		{name: "not a secret uri in a preview", secretId: "panadmin", dryRun: true, wantErr: "is not a key vault secret uri"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var secret bool
+			err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+				value, err := readKeyVaultSecret(ctx, test.secretId)
+				if err != nil {
+					return err
+				}
+				secret = pulumi.IsSecret(value)
+				return nil
+			}, pulumi.WithMocks("project", "test", &mocks{}), func(info *pulumi.RunInfo) { info.DryRun = test.dryRun })
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("readKeyVaultSecret() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readKeyVaultSecret() error = %v", err)
+			}
+			if !secret {
+				t.Error("readKeyVaultSecret() value is not secret")
+			}
+		})
+	}
+}
+
+// diskMocks is a recordingMocks whose existing disks are in the given zones.
+type diskMocks struct {
+	recordingMocks
+	zones []string
+}
+
+func (m *diskMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	if args.Token != "azure-native:compute:getDisk" {
+		return m.recordingMocks.Call(args)
+	}
+	var zones []interface{}
+	for _, zone := range m.zones {
+		zones = append(zones, zone)
+	}
+	return resource.NewPropertyMapFromMap(map[string]interface{}{"zones": zones}), nil
+}
+
+func TestApplyAttachedOsDiskZone(t *testing.T) {
+	const osDiskId = "/subscriptions/sub/resourceGroups/rg-disks/providers/Microsoft.Compute/disks/os-fw"
+	tests := []struct {
+		name      string
+		vmZone    string
+		diskZones []string
+		wantErr   string
+	}{
+		{name: "regional vm and disk"},
+		{name: "disk in the vm zone", vmZone: "1", diskZones: []string{"1"}},
+		{name: "disk in another zone", vmZone: "1", diskZones: []string{"2"}, wantErr: `vm "fw" is in zone "1", but its os disk "` + osDiskId + `" is in zones [2]`},
+		{name: "regional disk for a zonal vm", vmZone: "1", wantErr: `vm "fw" is in zone "1", but its os disk "` + osDiskId + `" is in zones []`},
+		{name: "zonal disk for a regional vm", diskZones: []string{"2"}, wantErr: `vm "fw" has no zone, but its os disk "` + osDiskId + `" is in zones [2]`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.VMs[0].OsDiskCreateOption, cfg.VMs[0].OsDiskId, cfg.VMs[0].Zone = "Attach", osDiskId, test.vmZone
+			cfg.VMs[0].Image = Image{}
+			plan, err := buildPlan(cfg)
+			if err != nil {
+				t.Fatalf("buildPlan() error = %v", err)
+			}
+			m := &diskMocks{zones: test.diskZones}
+			err = pulumi.RunErr(func(ctx *pulumi.Context) error {
+				return apply(ctx, plan)
+			}, pulumi.WithMocks("project", "test", m))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("apply() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if disks := m.byType("azure-native:compute:Disk"); len(disks) != 0 {
+				t.Errorf("disks = %v, want the os disk attached as it is", disks)
+			}
+			vm := m.byType("azure-native:compute:VirtualMachine")["vm-fw-panos-vm-test-"]
+			if id := vm.Inputs["storageProfile"].ObjectValue()["osDisk"].ObjectValue()["managedDisk"].ObjectValue()["id"]; id != resource.NewStringProperty(osDiskId) {
+				t.Errorf("attached os disk = %v, want %s", id, osDiskId)
+			}
+		})
+	}
+}